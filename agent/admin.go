@@ -0,0 +1,236 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConnectionStatus struct {
+	ServerUrl   string     `json:"serverUrl"`
+	Connected   bool       `json:"connected"`
+	ConnectedAt *time.Time `json:"connectedAt"`
+	LastPingAt  *time.Time `json:"lastPingAt"`
+}
+
+type BuildStatus struct {
+	BuildId string                 `json:"buildId"`
+	Command *protocol.BuildCommand `json:"command"`
+}
+
+type connectionTracker struct {
+	mu       sync.Mutex
+	status   ConnectionStatus
+	connects int
+}
+
+// connected returns true when the connection is not the first one.
+func (c *connectionTracker) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connects++
+	now := time.Now()
+	c.status.Connected = true
+	c.status.ConnectedAt = &now
+	return c.connects > 1
+}
+
+func (c *connectionTracker) disconnected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.Connected = false
+	c.status.ConnectedAt = nil
+}
+
+func (c *connectionTracker) pinged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.status.LastPingAt = &now
+}
+
+func (a *Agent) GetConnectionStatus() ConnectionStatus {
+	a.connection.mu.Lock()
+	defer a.connection.mu.Unlock()
+	status := a.connection.status
+	status.ServerUrl = a.Config().HttpsServerURL()
+	return status
+}
+
+func (a *Agent) GetBuildStatus() *BuildStatus {
+	session := a.runningBuildSession()
+	if session == nil {
+		return nil
+	}
+	return &BuildStatus{
+		BuildId: session.buildId,
+		Command: sanitizeCommand(session.command),
+	}
+}
+
+// sanitizeCommand copies the command tree for the admin endpoint,
+// with values of secret and export commands masked and secrets
+// masked in arguments of other commands like in the console log.
+func sanitizeCommand(cmd *protocol.BuildCommand) *protocol.BuildCommand {
+	var secrets []string
+	var collect func(cmd *protocol.BuildCommand)
+	collect = func(cmd *protocol.BuildCommand) {
+		if cmd == nil {
+			return
+		}
+		if cmd.Name == protocol.CommandSecret && cmd.Args["value"] != "" {
+			secrets = append(secrets, cmd.Args["value"])
+		}
+		for _, sub := range cmd.SubCommands {
+			collect(sub)
+		}
+		collect(cmd.Test)
+		collect(cmd.OnCancel)
+	}
+	collect(cmd)
+
+	var sanitize func(cmd *protocol.BuildCommand) *protocol.BuildCommand
+	sanitize = func(cmd *protocol.BuildCommand) *protocol.BuildCommand {
+		if cmd == nil {
+			return nil
+		}
+		c := *cmd
+		if cmd.Args != nil {
+			c.Args = make(map[string]string, len(cmd.Args))
+		}
+		for k, v := range cmd.Args {
+			if k == "value" && (cmd.Name == protocol.CommandSecret || cmd.Name == protocol.CommandExport) {
+				v = DefaultSecretMask
+			}
+			for _, secret := range secrets {
+				v = strings.Replace(v, secret, DefaultSecretMask, -1)
+			}
+			c.Args[k] = v
+		}
+		c.SubCommands = make([]*protocol.BuildCommand, len(cmd.SubCommands))
+		for i, sub := range cmd.SubCommands {
+			c.SubCommands[i] = sanitize(sub)
+		}
+		c.Test = sanitize(cmd.Test)
+		c.OnCancel = sanitize(cmd.OnCancel)
+		return &c
+	}
+	return sanitize(cmd)
+}
+
+// AdminHandler serves state of the given agents. JSON endpoints show
+// the first agent unless another one is picked by "agent" query
+// parameter with its id.
+func AdminHandler(agents ...*Agent) http.Handler {
+	admin := &adminHandler{agents: agents, logger: agents[0].logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range agents {
+			if a.IsShuttingDown() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/agents", admin.json(func(*Agent) interface{} {
+		ids := make([]string, 0, len(agents))
+		for _, a := range agents {
+			ids = append(ids, a.id)
+		}
+		return ids
+	}))
+	mux.HandleFunc("/runtime-info", admin.json(func(a *Agent) interface{} {
+		return a.GetAgentRuntimeInfo()
+	}))
+	mux.HandleFunc("/state", admin.json(func(a *Agent) interface{} {
+		return a.GetStates()
+	}))
+	mux.HandleFunc("/build", admin.json(func(a *Agent) interface{} {
+		return a.GetBuildStatus()
+	}))
+	mux.HandleFunc("/connection", admin.json(func(a *Agent) interface{} {
+		return a.GetConnectionStatus()
+	}))
+	mux.HandleFunc("/metrics", admin.metrics)
+	return mux
+}
+
+type adminHandler struct {
+	agents []*Agent
+	logger *Logger
+}
+
+func (h *adminHandler) agent(r *http.Request) *Agent {
+	id := r.URL.Query().Get("agent")
+	if id == "" {
+		return h.agents[0]
+	}
+	for _, a := range h.agents {
+		if a.id == id {
+			return a
+		}
+	}
+	return nil
+}
+
+func (h *adminHandler) json(data func(*Agent) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a := h.agent(r)
+		if a == nil {
+			http.Error(w, "unknown agent", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(data(a)); err != nil {
+			h.logger.Error.Printf("admin endpoint %v failed: %v", r.URL.Path, err)
+		}
+	}
+}
+
+// StartAdminServer serves AdminHandler of the agents on AdminAddress
+// of the first agent config, does nothing when the address is not
+// configured.
+func StartAdminServer(agents ...*Agent) error {
+	address := agents[0].Config().AdminAddress
+	if address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	logger := agents[0].logger
+	logger.Info.Printf("admin endpoint listening on %v", listener.Addr())
+	go func() {
+		err := http.Serve(listener, AdminHandler(agents...))
+		logger.Error.Printf("admin endpoint stopped: %v", err)
+	}()
+	return nil
+}
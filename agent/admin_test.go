@@ -0,0 +1,131 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminEndpointShowsCurrentBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.ExecCommand("sleep", "1"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	var build BuildStatus
+	assert.Equal(t, http.StatusOK, adminGet(t, "/build", &build))
+	assert.Equal(t, buildId, build.BuildId)
+	assert.Equal(t, "exec", build.Command.SubCommands[0].Name)
+
+	var states map[string]string
+	adminGet(t, "/state", &states)
+	assert.Equal(t, "Building", states["runtimeStatus"])
+
+	var conn ConnectionStatus
+	adminGet(t, "/connection", &conn)
+	assert.True(t, conn.Connected)
+	assert.Equal(t, goServerUrl, conn.ServerUrl)
+	assert.NotNil(t, conn.LastPingAt)
+
+	var info protocol.AgentRuntimeInfo
+	adminGet(t, "/runtime-info", &info)
+	assert.Equal(t, testAgent.Id(), info.Identifier.Uuid)
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	var idle *BuildStatus
+	adminGet(t, "/build", &idle)
+	assert.Nil(t, idle)
+	assert.Equal(t, http.StatusOK, adminGet(t, "/healthz", nil))
+}
+
+func TestAdminEndpointMasksSecretsOfCurrentBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.SecretCommand("s3cr3t"),
+		protocol.ExportCommand("TOKEN", "t0k3n", "false"),
+		protocol.ExecCommand("sleep", "0.5").SetOnCancel(echo("password is s3cr3t")),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	req := httptest.NewRequest(http.MethodGet, "/build", nil)
+	rec := httptest.NewRecorder()
+	AdminHandler(testAgent).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.False(t, contains(body, "s3cr3t"), body)
+	assert.False(t, contains(body, "t0k3n"), body)
+	assert.True(t, contains(body, "password is "+DefaultSecretMask), body)
+	assert.True(t, contains(body, `"name": "TOKEN"`), body)
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestAdminEndpointServesMetrics(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	AdminHandler(testAgent).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	label := Sprintf("agent=%q", testAgent.Id())
+	assert.True(t, contains(body, "\ngocd_agent_builds_total{"+label+",result=\"Passed\"} "), body)
+	assert.True(t, contains(body, "\ngocd_agent_command_duration_seconds_count{"+label+",command=\"echo\"} "), body)
+	assert.True(t, contains(body, "\ngocd_agent_reconnects_total{"+label+"} "), body)
+}
+
+func adminGet(t *testing.T, path string, v interface{}) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	AdminHandler(testAgent).ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%v returned invalid json: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminEndpointSelectsAgentById(t *testing.T) {
+	var ids []string
+	assert.Equal(t, http.StatusOK, adminGet(t, "/agents", &ids))
+	assert.Equal(t, 1, len(ids))
+	assert.Equal(t, testAgent.Id(), ids[0])
+
+	var info protocol.AgentRuntimeInfo
+	assert.Equal(t, http.StatusOK, adminGet(t, "/runtime-info?agent="+testAgent.Id(), &info))
+	assert.Equal(t, testAgent.Id(), info.Identifier.Uuid)
+	assert.Equal(t, http.StatusNotFound, adminGet(t, "/runtime-info?agent=unknown", nil))
+}
@@ -17,44 +17,91 @@
 package agent
 
 import (
+	"context"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/satori/go.uuid"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
-var (
-	buildSession *BuildSession
-	logger       *Logger
-	config       *Config
-	AgentId      string
-)
+// Agent connects to Go server and runs builds. Several agents can run
+// in one process as long as each has its own working and config
+// directory.
+type Agent struct {
+	id       string
+	configMu sync.RWMutex
+	config   *Config
+	logger   *Logger
 
-func LogDebug(format string, v ...interface{}) {
-	logger.Debug.Printf(format, v...)
-}
+	stateMu sync.Mutex
+	state   map[string]string
 
-func LogInfo(format string, v ...interface{}) {
-	logger.Info.Printf(format, v...)
-}
+	buildSession     *BuildSession
+	buildSessionMu   sync.Mutex
+	buildFinished    chan bool
+	buildCancelTimer *time.Timer
+	lastBuildStatus  string
+	idleSince        time.Time
+	oneShotDeadline  time.Time
+
+	buildStateMu sync.Mutex
+	buildState   *BuildState
+	crashedBuild *BuildState
+	recoverOnce  sync.Once
 
-func GetConfig() *Config {
-	return config
+	executorsMu sync.Mutex
+	executors   map[string]Executor
+	pluginsOnce sync.Once
+
+	outbox     *Outbox
+	reconnect  *Backoff
+	connection connectionTracker
+
+	shutdown        chan bool
+	shutdownOnce    sync.Once
+	gracePeriodOnce sync.Once
 }
 
-func Initialize() {
-	config = LoadConfig()
-	logger = MakeLogger(config.LogDir, "gocd-golang-agent.log", config.OutputDebugLog)
-	LogInfo(">>>>>>> go >>>>>>>")
-	LogInfo("working directory: %v", config.WorkingDir)
-	if _, err := os.Stat(config.WorkingDir); err != nil {
-		logger.Error.Fatal(err)
-	}
+// ErrReportsUndelivered stops a one-shot agent when Go server did not
+// acknowledge the reports of its build within SendMessageTimeout.
+var ErrReportsUndelivered = Err("one-shot build reports are not acknowledged by Go server")
 
+// NewAgent fails when config has no Go server url or working
+// directory, other settings left empty in a Config made without
+// LoadConfig get the same defaults LoadConfig gives them.
+func NewAgent(config *Config) (*Agent, error) {
+	if err := config.applyDefaults(); err != nil {
+		return nil, err
+	}
+	logger := NewLogger(LogOptions{
+		Dir:            config.LogDir,
+		File:           config.LogFile,
+		Level:          config.LogLevel,
+		Format:         config.LogFormat,
+		MaxSize:        config.LogMaxSize,
+		RotateInterval: config.LogRotateInterval,
+		MaxFiles:       config.LogMaxFiles,
+	})
+	a := &Agent{
+		config:    config,
+		state:     map[string]string{"runtimeStatus": "Idle"},
+		idleSince: time.Now(),
+		executors: Executors(),
+		reconnect: NewBackoff(config.Reconnect, SystemClock),
+		shutdown:  make(chan bool),
+	}
+	logger.Info.Printf(">>>>>>> go >>>>>>>")
+	logger.Info.Printf("working directory: %v", config.WorkingDir)
+	if err := Mkdirs(config.WorkingDir); err != nil {
+		return nil, err
+	}
 	if err := Mkdirs(config.ConfigDir); err != nil {
-		logger.Error.Fatal(err)
+		return nil, err
 	}
 
 	if _, err := os.Stat(config.AgentIdFile); err == nil {
@@ -62,111 +109,485 @@ func Initialize() {
 		if err2 != nil {
 			logger.Error.Printf("failed to read uuid file(%v): %v", config.AgentIdFile, err2)
 		} else {
-			AgentId = string(data)
+			a.id = string(data)
+		}
+	}
+	if a.id == "" {
+		a.id = uuid.NewV4().String()
+		ioutil.WriteFile(config.AgentIdFile, []byte(a.id), 0644)
+	}
+	a.logger = logger.With("agentId", a.id)
+	a.outbox = NewOutbox(a.logger)
+	initMetrics(a.id)
+	return a, nil
+}
+
+func (a *Agent) Id() string {
+	return a.id
+}
+
+// Config returns current settings of agent. ReloadConfig does not
+// change the returned Config but replaces it with a new one.
+func (a *Agent) Config() *Config {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config
+}
+
+func (a *Agent) Logger() *Logger {
+	return a.logger
+}
+
+// SetLogger replaces the logger agent was created with, e.g. by one
+// made with NewLogger and LogOptions.Output, and closes the log file
+// agent opened. Call it before Run.
+func (a *Agent) SetLogger(logger *Logger) {
+	created := a.logger
+	a.logger = logger.With("agentId", a.id)
+	a.outbox.logger = a.logger
+	if err := created.Close(); err != nil {
+		a.logger.Error.Printf("close log file failed: %v", err)
+	}
+}
+
+// RegisterExecutor adds a build command, or replaces a built-in one,
+// for builds received after the call.
+func (a *Agent) RegisterExecutor(name string, executor Executor) {
+	a.executorsMu.Lock()
+	defer a.executorsMu.Unlock()
+	a.executors[name] = executor
+}
+
+func (a *Agent) buildExecutors() map[string]Executor {
+	a.executorsMu.Lock()
+	defer a.executorsMu.Unlock()
+	executors := make(map[string]Executor, len(a.executors))
+	for name, executor := range a.executors {
+		executors[name] = executor
+	}
+	return executors
+}
+
+// SupportedCommands lists names of the build commands agent can run,
+// commands mapped to NotImplemented are left out.
+func (a *Agent) SupportedCommands() []string {
+	var names []string
+	for name, executor := range a.buildExecutors() {
+		if !isNotImplemented(executor) {
+			names = append(names, name)
 		}
 	}
-	if AgentId == "" {
-		AgentId = uuid.NewV4().String()
-		ioutil.WriteFile(config.AgentIdFile, []byte(AgentId), 0644)
+	sort.Strings(names)
+	return names
+}
+
+// Run keeps agent connected to Go server and reconnects on errors
+// until Shutdown is called, ctx is done, or a one-shot or idle agent
+// stops by itself. It returns ctx.Err() when stopped by ctx, and
+// ErrReportsUndelivered when a one-shot agent gives up delivering the
+// reports of its build.
+func (a *Agent) Run(ctx context.Context) error {
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.Shutdown()
+		case <-stop:
+		}
+	}()
+	for {
+		err := a.Start()
+		if err == nil || a.IsShuttingDown() && !a.IsBuilding() {
+			break
+		}
+		a.logger.Info.Printf("something wrong: %v", err.Error())
+		if !a.oneShotDeadline.IsZero() && time.Now().After(a.oneShotDeadline) {
+			a.logger.Error.Printf("give up delivering one-shot build reports")
+			return ErrReportsUndelivered
+		}
+		if a.IsShuttingDown() {
+			a.cancelBuildAfterGracePeriod()
+		}
+		if !a.WaitToReconnect() && !a.IsBuilding() {
+			break
+		}
 	}
+	a.logger.Info.Printf("agent stopped")
+	return ctx.Err()
 }
 
-func Start() error {
-	err := Register()
+func (a *Agent) Start() error {
+	if a.idleTimedOut() {
+		return nil
+	}
+	a.pluginsOnce.Do(a.loadPlugins)
+	a.recoverOnce.Do(a.recoverBuildState)
+	err := a.Register()
 	if err != nil {
 		return err
 	}
 
-	httpClient, err := GoServerRemoteClient(true)
+	httpClient, err := a.GoServerRemoteClient(true)
 	if err != nil {
 		return err
 	}
 
-	conn, err := MakeWebsocketConnection(config.WssServerURL(), config.HttpsServerURL())
+	conn, err := a.connect()
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	defer closeBuildSession()
+	defer func() {
+		conn.Close()
+		a.outbox.Requeue(conn.Unacked())
+	}()
+	if a.connection.connected() {
+		reconnectsTotal.Inc(a.id)
+	}
+	defer a.connection.disconnected()
+	defer a.detachBuildSession()
+
+	if a.buildCancelTimer != nil {
+		a.buildCancelTimer.Stop()
+		a.buildCancelTimer = nil
+	}
+	a.outbox.Attach(conn.Send)
+	defer a.outbox.Detach()
+	if !a.oneShotDeadline.IsZero() {
+		return a.stopOneShot(conn)
+	}
 
 	pingTick := time.NewTicker(10 * time.Second)
-	ping(conn.Send)
+	defer pingTick.Stop()
+	a.ping(conn.Send)
+	if err := a.reportCrashedBuild(httpClient, a.outbox.Send); err != nil {
+		return err
+	}
+
+	shuttingDown := a.ShuttingDown()
+	idleTimeout := a.idleTimer()
 	for {
 		select {
+		case <-idleTimeout:
+			a.logger.Info.Printf("no build in %v, stop agent", a.Config().IdleTimeout)
+			return nil
 		case <-pingTick.C:
-			ping(conn.Send)
+			a.ping(conn.Send)
+		case <-shuttingDown:
+			shuttingDown = nil
+			if a.buildFinished == nil {
+				return nil
+			}
+			a.cancelBuildAfterGracePeriod()
+		case <-a.buildFinished:
+			a.buildFinished = nil
+			a.idleSince = time.Now()
+			idleTimeout = a.idleTimer()
+			if a.Config().OneShot {
+				a.logger.Info.Printf("one-shot build %v, stop agent", a.lastBuildStatus)
+				a.oneShotDeadline = time.Now().Add(a.Config().SendMessageTimeout)
+				return a.stopOneShot(conn)
+			}
+			if a.IsShuttingDown() {
+				return nil
+			}
 		case msg, ok := <-conn.Received:
 			if !ok {
 				return Err("Websocket connection is closed")
 			}
-			err := processMessage(msg, httpClient, conn.Send)
+			err := a.processMessage(msg, httpClient, a.outbox.Send)
 			if err != nil {
 				return err
 			}
+			if a.buildFinished != nil {
+				idleTimeout = nil
+			}
 		}
 	}
 }
 
-func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *protocol.Message) error {
+// stopOneShot returns nil once Go server acknowledged every report of
+// the one-shot build. Reports queued while agent was disconnected are
+// replayed when conn is attached, reports conn fails to deliver are
+// requeued by Start and replayed after reconnecting.
+func (a *Agent) stopOneShot(conn *WebsocketConnection) error {
+	timeout := time.NewTimer(time.Until(a.oneShotDeadline))
+	defer timeout.Stop()
+	detached := make(chan bool)
+	go func() {
+		a.outbox.Detach()
+		close(detached)
+	}()
+	select {
+	case <-detached:
+	case <-timeout.C:
+		// outbox is handing a message to conn, which is still resending
+		// the one before; breaking conn makes it take the message
+		conn.Conn.Close()
+		<-detached
+	}
+	if conn.Drain(time.Until(a.oneShotDeadline)) && a.outbox.Pending() == 0 {
+		return nil
+	}
+	return Err("one-shot build reports are not delivered yet")
+}
+
+func (a *Agent) connect() (conn *WebsocketConnection, err error) {
+	for i := 0; i < a.Config().Servers.Len(); i++ {
+		server := a.Config().ServerUrl()
+		if err = a.ReadGoServerCACert(); err == nil {
+			conn, err = a.MakeWebsocketConnection(a.Config().WssServerURL(), a.Config().HttpsServerURL())
+			if err == nil {
+				return conn, nil
+			}
+		}
+		a.logger.Error.Printf("connect to Go server %v failed: %v", server, err)
+		a.failoverFrom(server)
+	}
+	return nil, err
+}
+
+func (a *Agent) failoverFrom(server *url.URL) {
+	if next := a.Config().Servers.FailoverFrom(server); next != server {
+		a.logger.Warn.Printf("failover from Go server %v to %v", server, next)
+	}
+}
+
+func (a *Agent) processMessage(msg *protocol.Message, httpClient *http.Client, send chan *protocol.Message) error {
 	switch msg.Action {
 	case protocol.SetCookieAction:
-		SetState("cookie", msg.DataString())
+		cookie, err := msg.DataString()
+		if err != nil {
+			a.rejectMessage(msg, err, send)
+			return nil
+		}
+		a.SetState("cookie", cookie)
 	case protocol.CancelBuildAction:
-		closeBuildSession()
+		a.closeBuildSession()
 	case protocol.ReregisterAction:
-		CleanRegistration()
+		a.CleanRegistration()
 		return Err("received reregister message")
 	case protocol.BuildAction:
-		closeBuildSession()
-		build := msg.DataBuild()
-		SetState("buildLocator", build.BuildLocator)
-		SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
-		curl, err := config.MakeFullServerURL(build.ConsoleUrl)
+		if a.IsShuttingDown() {
+			a.logger.Info.Printf("agent is shutting down, ignore build message")
+			return nil
+		}
+		if a.Config().OneShot && a.buildFinished != nil {
+			a.logger.Info.Printf("one-shot agent is running a build, ignore build message")
+			return nil
+		}
+		build, err := msg.DataBuild()
+		if err != nil {
+			a.rejectMessage(msg, err, send)
+			return nil
+		}
+		a.closeBuildSession()
+		a.SetState("buildLocator", build.BuildLocator)
+		a.SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
+		curl, err := a.Config().MakeFullServerURL(build.ConsoleUrl)
 		if err != nil {
 			return err
 		}
-		aurl, err := config.MakeFullServerURL(build.ArtifactUploadBaseUrl)
+		aurl, err := a.Config().MakeFullServerURL(build.ArtifactUploadBaseUrl)
 		if err != nil {
 			return err
 		}
-		buildSession = MakeBuildSession(
+		purl, err := a.Config().MakeFullServerURL(build.PropertyBaseUrl)
+		if err != nil {
+			return err
+		}
+		session := MakeBuildSession(
+			a,
 			build.BuildId,
 			build.BuildCommand,
-			MakeBuildConsole(httpClient, curl),
-			&Artifacts{httpClient: httpClient},
+			MakeBuildConsole(httpClient, curl, a.logger, a.id),
+			&Artifacts{httpClient: httpClient, logger: a.logger, agentId: a.id},
 			aurl,
+			purl,
 			send,
-			config.WorkingDir,
+			a.Config().WorkingDir,
 		)
-		buildSession.ReplaceEcho("${agent.location}", config.WorkingDir)
-		buildSession.ReplaceEcho("${agent.hostname}", config.Hostname)
-		buildSession.ReplaceEcho("${date}", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
-		go processBuild(send, buildSession)
+		session.ReplaceEcho("${agent.location}", a.Config().WorkingDir)
+		session.ReplaceEcho("${agent.hostname}", a.Config().Hostname)
+		session.ReplaceEcho("${date}", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
+		a.buildSessionMu.Lock()
+		a.buildSession = session
+		a.buildSessionMu.Unlock()
+		a.saveBuildState(&BuildState{
+			BuildId:                build.BuildId,
+			BuildLocator:           build.BuildLocator,
+			BuildLocatorForDisplay: build.BuildLocatorForDisplay,
+			ConsoleUrl:             build.ConsoleUrl,
+		})
+		a.buildFinished = make(chan bool)
+		go a.processBuild(send, session, a.buildFinished)
 	default:
-		panic(Sprintf("Unknown message action: %+v", msg))
+		a.rejectMessage(msg, Err("unknown action %v", msg.Action), send)
 	}
 	return nil
 }
 
-func processBuild(send chan *protocol.Message, buildSession *BuildSession) {
+// rejectMessage tells Go server that agent ignored a message it could
+// not process.
+func (a *Agent) rejectMessage(msg *protocol.Message, err error, send chan *protocol.Message) {
+	messageErrors.Inc(a.id)
+	a.logger.Warn.Printf("ignore message: %v", err)
+	send <- protocol.MessageErrorMessage(msg, err)
+}
+
+func (a *Agent) processBuild(send chan *protocol.Message, buildSession *BuildSession, finished chan bool) {
 	defer func() {
-		SetState("runtimeStatus", "Idle")
-		ping(send)
-		logger.Debug.Printf("! exit goroutine: process build command message")
+		a.SetState("runtimeStatus", "Idle")
+		a.ping(send)
+		close(finished)
+		a.logger.Debug.Printf("! exit goroutine: process build command message")
 	}()
-	SetState("runtimeStatus", "Building")
-	ping(send)
+	a.SetState("runtimeStatus", "Building")
+	a.ping(send)
 	buildSession.Run()
-	LogInfo("done")
+	a.clearBuildState(buildSession.buildId)
+	a.lastBuildStatus = buildSession.buildStatus
+	a.logger.Info.Printf("done")
 }
 
-func ping(send chan *protocol.Message) {
-	send <- protocol.PingMessage(GetAgentRuntimeInfo())
+func (a *Agent) ping(send chan *protocol.Message) {
+	send <- protocol.PingMessage(a.GetAgentRuntimeInfo())
+	a.connection.pinged()
 }
 
-func closeBuildSession() {
-	if buildSession != nil {
-		buildSession.Close()
-		buildSession = nil
+// runningBuildSession returns nil when there is no build running.
+func (a *Agent) runningBuildSession() *BuildSession {
+	a.buildSessionMu.Lock()
+	defer a.buildSessionMu.Unlock()
+	if a.buildSession == nil || isClosedChan(a.buildSession.done) {
+		return nil
 	}
+	return a.buildSession
+}
+
+func (a *Agent) closeBuildSession() {
+	a.buildSessionMu.Lock()
+	session := a.buildSession
+	a.buildSession = nil
+	a.buildSessionMu.Unlock()
+	if session != nil {
+		session.Close()
+	}
+}
+
+// detachBuildSession keeps the running build going after the
+// connection is gone, and only cancels it when agent can't connect
+// back to server in time.
+func (a *Agent) detachBuildSession() {
+	if !a.IsBuilding() {
+		return
+	}
+	timeout := a.Config().ReconnectBuildTimeout
+	a.logger.Info.Printf("connection is closed, build will be canceled if agent does not reconnect in %v", timeout)
+	a.buildCancelTimer = time.AfterFunc(timeout, func() {
+		a.logger.Info.Printf("agent did not reconnect in %v, cancel build", timeout)
+		a.closeBuildSession()
+	})
+}
+
+// LastBuildStatus returns result of the last finished build, empty
+// when agent has not run any build.
+func (a *Agent) LastBuildStatus() string {
+	return a.lastBuildStatus
+}
+
+func (a *Agent) idleTimer() <-chan time.Time {
+	if a.Config().IdleTimeout == 0 || a.buildFinished != nil {
+		return nil
+	}
+	return time.After(a.Config().IdleTimeout - time.Since(a.idleSince))
+}
+
+func (a *Agent) idleTimedOut() bool {
+	if a.Config().IdleTimeout == 0 || a.buildFinished != nil || time.Since(a.idleSince) < a.Config().IdleTimeout {
+		return false
+	}
+	a.logger.Info.Printf("no build in %v, stop agent", a.Config().IdleTimeout)
+	return true
+}
+
+func (a *Agent) IsBuilding() bool {
+	return a.buildFinished != nil && !isClosedChan(a.buildFinished)
+}
+
+func (a *Agent) Shutdown() {
+	a.shutdownOnce.Do(func() {
+		a.logger.Info.Printf("shutting down agent")
+		close(a.shutdown)
+	})
+}
+
+// cancelBuildAfterGracePeriod gives the running build
+// ShutdownGracePeriod to finish once agent is shutting down, no matter
+// whether agent is connected to Go server meanwhile.
+func (a *Agent) cancelBuildAfterGracePeriod() {
+	a.gracePeriodOnce.Do(func() {
+		period := a.Config().ShutdownGracePeriod
+		a.logger.Info.Printf("wait %v for current build to finish before shutdown", period)
+		time.AfterFunc(period, func() {
+			if a.runningBuildSession() == nil {
+				return
+			}
+			a.logger.Info.Printf("build did not finish in %v, cancel it", period)
+			a.closeBuildSession()
+		})
+	})
+}
+
+// ReloadConfig re-reads settings that can be changed without
+// reconnecting to Go server.
+func (a *Agent) ReloadConfig() error {
+	reloaded, errs := loadConfig()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			a.logger.Error.Printf("reload config failed: %v", err)
+		}
+		return errs[0]
+	}
+	a.configMu.Lock()
+	c := *a.config
+	c.AgentAutoRegisterKey = reloaded.AgentAutoRegisterKey
+	c.AgentAutoRegisterResources = reloaded.AgentAutoRegisterResources
+	c.AgentAutoRegisterEnvironments = reloaded.AgentAutoRegisterEnvironments
+	c.OutputDebugLog = reloaded.OutputDebugLog
+	c.LogLevel = reloaded.LogLevel
+	c.SendMessageTimeout = reloaded.SendMessageTimeout
+	c.ServerSilenceTimeout = reloaded.ServerSilenceTimeout
+	c.ShutdownGracePeriod = reloaded.ShutdownGracePeriod
+	c.ReconnectBuildTimeout = reloaded.ReconnectBuildTimeout
+	c.Reconnect = reloaded.Reconnect
+	a.config = &c
+	a.configMu.Unlock()
+
+	a.logger.SetLevel(c.LogLevel)
+	a.reconnect.SetPolicy(c.Reconnect)
+	a.logger.Info.Printf("config reloaded from %v", c.ConfigFile)
+	return nil
+}
+
+// WaitToReconnect sleeps before the next connect attempt, it returns
+// false when agent is shut down meanwhile. An agent shutting down with
+// a build still running keeps reconnecting, so that it can report the
+// build once it is finished or canceled.
+func (a *Agent) WaitToReconnect() bool {
+	delay := a.reconnect.NextDelay()
+	a.logger.Info.Printf("sleep %v and restart", delay)
+	if a.IsShuttingDown() && a.IsBuilding() {
+		a.reconnect.Sleep(delay, a.buildFinished)
+		return true
+	}
+	return a.reconnect.Sleep(delay, a.shutdown)
+}
+
+func (a *Agent) ShuttingDown() <-chan bool {
+	return a.shutdown
+}
+
+func (a *Agent) IsShuttingDown() bool {
+	return isClosedChan(a.shutdown)
 }
@@ -43,15 +43,16 @@ var (
 	stateLog     *StateLog
 	buildId      string
 	agentStopped chan bool
+	testAgent    *Agent
 )
 
 func TestSetCookieAfterConnected(t *testing.T) {
 	setUp(t)
 	defer tearDown()
-	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.EchoCommand("hello"))
 
 	assert.Equal(t, "agent Building", stateLog.Next())
-	assert.NotEqual(t, "", GetState("cookie"))
+	assert.NotEqual(t, "", testAgent.GetState("cookie"))
 	assert.Equal(t, "build Passed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
 }
@@ -85,7 +86,14 @@ func TestMain(m *testing.M) {
 	os.Setenv("GOCD_AGENT_WORKING_DIR", agentWorkingDir)
 	os.Setenv("GOCD_AGENT_LOG_DIR", agentWorkingDir)
 
-	Initialize()
+	config, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+	testAgent, err = NewAgent(config)
+	if err != nil {
+		panic(err)
+	}
 
 	os.Exit(m.Run())
 }
@@ -157,6 +165,10 @@ func (log *StateLog) Notify(class, id, state string) {
 		if id == log.buildId {
 			log.notify("build " + state)
 		}
+	case "messageError":
+		if id == log.agentId {
+			log.notify("messageError " + state)
+		}
 	}
 }
 
@@ -288,7 +300,7 @@ func relativePath(wd string) string {
 func startAgent(t *testing.T) chan bool {
 	done := make(chan bool)
 	go func() {
-		err := Start()
+		err := testAgent.Start()
 		if err.Error() != "received reregister message" {
 			t.Error("Unexpected error to quit agent: ", err)
 		}
@@ -299,17 +311,20 @@ func startAgent(t *testing.T) chan bool {
 }
 
 func setUp(t *testing.T) {
-	pc, _, _, _ := runtime.Caller(1)
+	buildId = callerName(2)
+	stateLog.Reset(buildId, testAgent.Id())
+	agentStopped = startAgent(t)
+}
+
+func callerName(skip int) string {
+	pc, _, _, _ := runtime.Caller(skip)
 	_func := runtime.FuncForPC(pc)
 	parts := strings.Split(_func.Name(), ".")
-
-	buildId = parts[len(parts)-1]
-	stateLog.Reset(buildId, AgentId)
-	agentStopped = startAgent(t)
+	return parts[len(parts)-1]
 }
 
 func tearDown() {
-	goServer.Send(AgentId, protocol.ReregisterMessage())
+	goServer.Send(testAgent.Id(), protocol.ReregisterMessage())
 	select {
 	case <-time.After(5 * time.Second):
 		panic("wait for agent stop timeout")
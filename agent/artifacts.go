@@ -33,6 +33,8 @@ import (
 
 type Artifacts struct {
 	httpClient *http.Client
+	logger     *Logger
+	agentId    string
 }
 
 func (u *Artifacts) DownloadFile(source *url.URL, destPath string) (err error) {
@@ -54,7 +56,7 @@ func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
 		return err
 	}
 	defer os.Remove(zipfile.Name())
-	LogDebug("tmp file created for download zipped dir")
+	u.logger.Debug.Printf("tmp file created for download zipped dir")
 	err = u.downloadFile(source, zipfile)
 	if err != nil {
 		return err
@@ -64,45 +66,46 @@ func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
 	if err != nil {
 		return err
 	}
-	LogDebug("unzip to %v", destPath)
+	u.logger.Debug.Printf("unzip to %v", destPath)
 	defer zipReader.Close()
 	destDir := filepath.Dir(destPath)
 	for _, file := range zipReader.File {
 		dest := filepath.Join(destDir, file.FileHeader.Name)
 		if file.FileHeader.FileInfo().IsDir() {
-			LogDebug("mkdirs %v", dest)
+			u.logger.Debug.Printf("mkdirs %v", dest)
 			err = Mkdirs(dest)
 		} else {
-			LogDebug("extract file %v => %v", file.FileHeader.Name, dest)
+			u.logger.Debug.Printf("extract file %v => %v", file.FileHeader.Name, dest)
 			err = u.extractFile(file, dest)
 		}
 		if err != nil {
 			return err
 		}
 	}
-	LogDebug("unzip finished")
+	u.logger.Debug.Printf("unzip finished")
 	return nil
 }
 
 func (u *Artifacts) downloadFile(source *url.URL, destFile *os.File) (err error) {
 	defer destFile.Close()
-	LogDebug("download file %v => %v", source, destFile.Name())
+	u.logger.Debug.Printf("download file %v => %v", source, destFile.Name())
 	retry := 0
 startDownload:
 	resp, err := u.httpClient.Get(source.String())
 	if err != nil {
 		return
 	}
-	LogDebug("response: %v", resp.Status)
+	u.logger.Debug.Printf("response: %v", resp.Status)
 	if resp.StatusCode == http.StatusAccepted {
-		LogDebug("Server responsed StatusAccepted, sleep 1 sec and start download again")
+		u.logger.Debug.Printf("Server responsed StatusAccepted, sleep 1 sec and start download again")
 		time.Sleep(1 * time.Second)
 		goto startDownload
 	}
 	if resp.StatusCode != http.StatusOK {
 		if retry < 3 {
 			retry++
-			LogDebug("sleep %v sec and start download again", retry)
+			artifactDownloadRetries.Inc(u.agentId)
+			u.logger.Debug.Printf("sleep %v sec and start download again", retry)
 			time.Sleep(time.Duration(retry) * time.Second)
 			goto startDownload
 		} else {
@@ -110,7 +113,8 @@ startDownload:
 		}
 	}
 	defer resp.Body.Close()
-	_, err = io.Copy(destFile, resp.Body)
+	n, err := io.Copy(destFile, resp.Body)
+	artifactDownloadBytes.Add(float64(n), u.agentId)
 	return
 }
 
@@ -175,6 +179,7 @@ func (u *Artifacts) Upload(source, destPath string, destURL *url.URL) (err error
 		return
 	}
 
+	size := body.Len()
 	attempt := 1
 tryPost:
 	attemptUrl := AppendUrlParam(destURL, "attempt", strconv.Itoa(attempt))
@@ -185,6 +190,7 @@ tryPost:
 	}
 	// success
 	if statusCode == http.StatusCreated {
+		artifactUploadBytes.Add(float64(size), u.agentId)
 		return
 	}
 	// handle errors
@@ -195,11 +201,27 @@ tryPost:
 	// retry for other errors
 	if attempt < 3 {
 		attempt++
+		artifactUploadRetries.Inc(u.agentId)
 		goto tryPost
 	}
 	return Err("Failed to upload %v. Server response: %v", source, statusCode)
 }
 
+// SetProperty posts build property name to Go server under baseURL.
+func (u *Artifacts) SetProperty(baseURL *url.URL, name, value string) error {
+	propertyURL := Join("/", baseURL.String(), url.PathEscape(name))
+	resp, err := u.httpClient.PostForm(propertyURL, url.Values{"value": {value}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return Err("Server response: %v %v", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
 func (u *Artifacts) post(source, contentType string, destURL *url.URL, body *bytes.Buffer) (statusCode int, err error) {
 	req, err := http.NewRequest("POST", destURL.String(), body)
 	if err != nil {
@@ -35,7 +35,7 @@ func TestUploadArtifactFailed(t *testing.T) {
 	wd := createPipelineDir()
 	fname := "nofile"
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.UploadArtifactCommand(fname, "", "false").Setwd(relativePath(wd)),
 	)
 
@@ -56,7 +56,7 @@ func TestIgnoreUnmatchError(t *testing.T) {
 	wd := createPipelineDir()
 	fname := "nofile"
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.UploadArtifactCommand(fname, "", "true").Setwd(relativePath(wd)),
 	)
 
@@ -77,7 +77,7 @@ func TestUploadArtifactFailedWhenServerHasNotEnoughDiskspace(t *testing.T) {
 		buf.WriteString("large file content")
 	}
 	writeFile(wd, "large.txt", buf.String())
-	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("large.txt", "", "false").Setwd(relativePath(wd)))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.UploadArtifactCommand("large.txt", "", "false").Setwd(relativePath(wd)))
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Failed", stateLog.Next())
@@ -280,7 +280,7 @@ func TestProcessMultipleUploadArtifactCommands(t *testing.T) {
 	defer tearDown()
 
 	wd := createTestProjectInPipelineDir()
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.UploadArtifactCommand("src/hello/3.txt", "dest", "false").Setwd(relativePath(wd)),
 		protocol.UploadArtifactCommand("test/5.txt", "", "false").Setwd(relativePath(wd)),
 		protocol.UploadArtifactCommand("test/**/10.txt", "dest", "false").Setwd(relativePath(wd)),
@@ -309,7 +309,7 @@ dest/world2/10.txt=41e43efb30d3fbfcea93542157809ac0
 
 func testUpload(t *testing.T, srcPath, destDir, checksum string, src2dest map[string]string) {
 	wd := createTestProjectInPipelineDir()
-	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand(srcPath, destDir, "false").Setwd(relativePath(wd)))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.UploadArtifactCommand(srcPath, destDir, "false").Setwd(relativePath(wd)))
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Passed", stateLog.Next())
@@ -384,7 +384,7 @@ func TestDownloadArtifactDir(t *testing.T) {
 }
 
 func testDownload(t *testing.T, wd, srcPath, destDir string, destFiles []string, sourceIsDir bool) {
-	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Passed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -401,7 +401,7 @@ func testDownload(t *testing.T, wd, srcPath, destDir string, destFiles []string,
 		destPath := Join("/", destDir, fname)
 		cmd = protocol.DownloadFileCommand(srcPath, srcUrl, destPath, checksumUrl, checksumPath)
 	}
-	goServer.SendBuild(AgentId, buildId, cmd.Setwd(relativePath(wd)))
+	goServer.SendBuild(testAgent.Id(), buildId, cmd.Setwd(relativePath(wd)))
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Passed", stateLog.Next())
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var SystemClock Clock = systemClock{}
+
+type ReconnectPolicy struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Jitter     float64
+	ResetAfter time.Duration
+}
+
+// Backoff computes delays between reconnect attempts. Delays grow
+// exponentially from BaseDelay up to MaxDelay, and start over once a
+// connection has stayed healthy for ResetAfter.
+type Backoff struct {
+	Policy ReconnectPolicy
+	Clock  Clock
+	Random func() float64
+
+	mu           sync.Mutex
+	attempts     uint
+	healthySince time.Time
+}
+
+func NewBackoff(policy ReconnectPolicy, clock Clock) *Backoff {
+	return &Backoff{
+		Policy: policy,
+		Clock:  clock,
+		Random: rand.Float64,
+	}
+}
+
+func (b *Backoff) SetPolicy(policy ReconnectPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Policy = policy
+}
+
+func (b *Backoff) Healthy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthySince = b.Clock.Now()
+}
+
+func (b *Backoff) NextDelay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.healthySince.IsZero() && b.Clock.Now().Sub(b.healthySince) >= b.Policy.ResetAfter {
+		b.attempts = 0
+	}
+	b.healthySince = time.Time{}
+
+	delay := b.Policy.BaseDelay
+	for i := uint(0); i < b.attempts && delay < b.Policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.Policy.MaxDelay {
+		delay = b.Policy.MaxDelay
+	}
+	b.attempts++
+	return delay - time.Duration(float64(delay)*b.Policy.Jitter*b.Random())
+}
+
+func (b *Backoff) Wait(stop <-chan bool) bool {
+	return b.Sleep(b.NextDelay(), stop)
+}
+
+func (b *Backoff) Sleep(delay time.Duration, stop <-chan bool) bool {
+	select {
+	case <-b.Clock.After(delay):
+		return true
+	case <-stop:
+		return false
+	}
+}
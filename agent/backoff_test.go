@@ -0,0 +1,111 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+type FakeClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *FakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func makeTestBackoff(jitter float64) (*Backoff, *FakeClock) {
+	clock := &FakeClock{now: time.Now()}
+	backoff := NewBackoff(ReconnectPolicy{
+		BaseDelay:  time.Second,
+		MaxDelay:   10 * time.Second,
+		Jitter:     jitter,
+		ResetAfter: time.Minute,
+	}, clock)
+	backoff.Random = func() float64 { return 1 }
+	return backoff, clock
+}
+
+func TestBackoffDelayGrowsExponentiallyUpToMaxDelay(t *testing.T) {
+	backoff, _ := makeTestBackoff(0)
+	assert.Equal(t, time.Second, backoff.NextDelay())
+	assert.Equal(t, 2*time.Second, backoff.NextDelay())
+	assert.Equal(t, 4*time.Second, backoff.NextDelay())
+	assert.Equal(t, 8*time.Second, backoff.NextDelay())
+	assert.Equal(t, 10*time.Second, backoff.NextDelay())
+	assert.Equal(t, 10*time.Second, backoff.NextDelay())
+}
+
+func TestBackoffJitterCutsOffFractionOfDelay(t *testing.T) {
+	backoff, _ := makeTestBackoff(0.5)
+	assert.Equal(t, 500*time.Millisecond, backoff.NextDelay())
+	backoff.Random = func() float64 { return 0 }
+	assert.Equal(t, 2*time.Second, backoff.NextDelay())
+	backoff.Random = func() float64 { return 0.5 }
+	assert.Equal(t, 3*time.Second, backoff.NextDelay())
+}
+
+func TestBackoffResetsAfterHealthyPeriod(t *testing.T) {
+	backoff, clock := makeTestBackoff(0)
+	backoff.NextDelay()
+	backoff.NextDelay()
+	backoff.NextDelay()
+
+	backoff.Healthy()
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Second, backoff.NextDelay())
+	assert.Equal(t, 2*time.Second, backoff.NextDelay())
+}
+
+func TestBackoffKeepsGrowingWhenConnectionIsNotHealthyLongEnough(t *testing.T) {
+	backoff, clock := makeTestBackoff(0)
+	backoff.NextDelay()
+	backoff.NextDelay()
+
+	backoff.Healthy()
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, 4*time.Second, backoff.NextDelay())
+}
+
+func TestBackoffWaitSleepsOnClock(t *testing.T) {
+	backoff, clock := makeTestBackoff(0)
+	assert.True(t, backoff.Wait(make(chan bool)))
+	assert.True(t, backoff.Wait(make(chan bool)))
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, clock.waits)
+}
+
+func TestBackoffWaitReturnsWhenStopped(t *testing.T) {
+	backoff := NewBackoff(ReconnectPolicy{BaseDelay: time.Hour, MaxDelay: time.Hour}, SystemClock)
+	stop := make(chan bool)
+	close(stop)
+	assert.Equal(t, false, backoff.Wait(stop))
+}
@@ -19,7 +19,6 @@ package agent
 import (
 	"bytes"
 	"github.com/gocd-contrib/gocd-golang-agent/stream"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"time"
@@ -32,6 +31,8 @@ type BuildConsole struct {
 	stop       chan bool
 	closed     chan bool
 	write      chan []byte
+	logger     *Logger
+	agentId    string
 }
 
 func timestampPrefix() []byte {
@@ -39,10 +40,12 @@ func timestampPrefix() []byte {
 	return []byte(ts)
 }
 
-func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
+func MakeBuildConsole(httpClient *http.Client, url *url.URL, logger *Logger, agentId string) *BuildConsole {
 	console := BuildConsole{
 		HttpClient: httpClient,
 		Url:        url,
+		logger:     logger,
+		agentId:    agentId,
 		buffer:     bytes.NewBuffer(make([]byte, 0, 10*1024)),
 
 		stop:   make(chan bool),
@@ -52,7 +55,7 @@ func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
 	go func() {
 		defer func() {
 			close(console.closed)
-			LogInfo("build console closed")
+			console.logger.Info.Printf("build console closed")
 		}()
 		tw := stream.NewPrefixWriter(console.buffer, timestampPrefix)
 		flushTick := time.NewTicker(5 * time.Second)
@@ -86,18 +89,16 @@ func (console *BuildConsole) Flush() {
 	if console.buffer.Len() == 0 {
 		return
 	}
-	LogDebug("ConsoleLog: \n%v", console.buffer.String())
+	console.logger.Debug.Printf("ConsoleLog: \n%v", console.buffer.String())
 
-	req := http.Request{
-		Method:        http.MethodPut,
-		URL:           console.Url,
-		Body:          ioutil.NopCloser(console.buffer),
-		ContentLength: int64(console.buffer.Len()),
-		Close:         true,
+	req, err := http.NewRequest(http.MethodPut, console.Url.String(), bytes.NewReader(console.buffer.Bytes()))
+	if err == nil {
+		req.Close = true
+		_, err = console.HttpClient.Do(req)
 	}
-	_, err := console.HttpClient.Do(&req)
 	if err != nil {
-		logger.Error.Printf("build console flush failed: %v", err)
+		consoleFlushFailures.Inc(console.agentId)
+		console.logger.Error.Printf("build console flush failed: %v", err)
 	}
 	console.buffer.Reset()
 }
@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -61,16 +62,22 @@ func Executors() map[string]Executor {
 		protocol.CommandDownloadDir:         CommandDownloadArtifact,
 		protocol.CommandFail:                CommandFail,
 		protocol.CommandGenerateTestReport:  CommandGenerateTestReport,
-		protocol.CommandGenerateProperty:    NotImplemented,
+		protocol.CommandGenerateProperty:    CommandGenerateProperty,
+		protocol.CommandRetry:               CommandRetry,
+		protocol.CommandParallel:            CommandParallel,
+		protocol.CommandForeach:             CommandForeach,
 	}
 }
 
 type BuildSession struct {
+	agent                 *Agent
+	logger                *Logger
 	send                  chan *protocol.Message
 	console               io.WriteCloser
 	artifacts             *Artifacts
 	command               *protocol.BuildCommand
 	artifactUploadBaseURL *url.URL
+	propertyBaseURL       *url.URL
 
 	envs    map[string]string
 	cancel  chan bool
@@ -87,21 +94,26 @@ type BuildSession struct {
 	executors map[string]Executor
 }
 
-func MakeBuildSession(buildId string,
+func MakeBuildSession(agent *Agent,
+	buildId string,
 	command *protocol.BuildCommand,
 	console io.WriteCloser,
 	artifacts *Artifacts,
 	artifactUploadBaseURL *url.URL,
+	propertyBaseURL *url.URL,
 	send chan *protocol.Message,
 	rootDir string) *BuildSession {
 
 	secrets := stream.NewSubstituteWriter(console)
 	return &BuildSession{
+		agent:                 agent,
+		logger:                agent.logger.With("buildId", buildId),
 		buildId:               buildId,
 		buildStatus:           protocol.BuildPassed,
 		console:               console,
 		artifacts:             artifacts,
 		artifactUploadBaseURL: artifactUploadBaseURL,
+		propertyBaseURL:       propertyBaseURL,
 		command:               command,
 		send:                  send,
 		envs:                  make(map[string]string),
@@ -110,7 +122,7 @@ func MakeBuildSession(buildId string,
 		secrets:               secrets,
 		echo:                  stream.NewSubstituteWriter(secrets),
 		rootDir:               rootDir,
-		executors:             Executors(),
+		executors:             agent.buildExecutors(),
 	}
 }
 
@@ -131,15 +143,53 @@ func (s *BuildSession) isCanceled() bool {
 }
 
 func (s *BuildSession) Run() error {
+	start := time.Now()
 	defer func() {
+		buildsTotal.Inc(s.agent.id, s.buildStatus)
+		observeSince(buildDuration, start, s.agent.id, s.buildStatus)
 		s.console.Close()
 		s.send <- protocol.CompletedMessage(s.Report(""))
-		LogInfo("Build completed")
+		s.logger.Info.Printf("Build completed")
 	}()
-	LogInfo("Build started, root directory: %v", s.rootDir)
+	s.logger.Info.Printf("Build started, root directory: %v", s.rootDir)
+	if unsupported := s.unsupportedCommands(s.command); len(unsupported) > 0 {
+		defer close(s.done)
+		s.buildStatus = protocol.BuildFailed
+		errMsg := Sprintf("ERROR: Build uses commands this agent does not support: %v\n", strings.Join(unsupported, ", "))
+		s.logger.Info.Printf("%v", errMsg)
+		s.ConsoleLog("%v", errMsg)
+		return Err("unsupported commands: %v", unsupported)
+	}
 	return s.ProcessCommand()
 }
 
+// unsupportedCommands walks the command tree and returns sorted names
+// that have no executor or are mapped to NotImplemented.
+func (s *BuildSession) unsupportedCommands(cmd *protocol.BuildCommand) []string {
+	unknown := make(map[string]bool)
+	var walk func(cmd *protocol.BuildCommand)
+	walk = func(cmd *protocol.BuildCommand) {
+		if cmd == nil {
+			return
+		}
+		if executor, ok := s.executors[cmd.Name]; !ok || isNotImplemented(executor) {
+			unknown[cmd.Name] = true
+		}
+		for _, sub := range cmd.SubCommands {
+			walk(sub)
+		}
+		walk(cmd.Test)
+		walk(cmd.OnCancel)
+	}
+	walk(cmd)
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (s *BuildSession) ProcessCommand() error {
 	defer func() {
 		close(s.done)
@@ -166,14 +216,18 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 		return nil
 	}
 
-	err = s.doProcess(cmd)
+	if cmd.Timeout != "" {
+		err = s.processWithTimeout(cmd)
+	} else {
+		err = s.doProcess(cmd)
+	}
 	if s.isCanceled() {
-		LogInfo("build canceled")
+		s.logger.Info.Printf("build canceled")
 		s.buildStatus = protocol.BuildCanceled
 	} else if err != nil && s.buildStatus != protocol.BuildFailed {
 		s.buildStatus = protocol.BuildFailed
 		errMsg := Sprintf("ERROR: %v\n", err)
-		LogInfo(errMsg)
+		s.logger.Info.Printf(errMsg)
 		s.ConsoleLog(errMsg)
 	}
 
@@ -200,10 +254,80 @@ func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
 	if exec == nil {
 		return Err("Unknown build command: %v", cmd.Name)
 	} else {
+		defer observeSince(commandDuration, time.Now(), s.agent.id, cmd.Name)
+		defer func(logger *Logger) { s.logger = logger }(s.logger)
+		s.logger = s.logger.With("command", cmd.Name)
 		return exec(s, cmd)
 	}
 }
 
+// processWithTimeout processes cmd in a session that is canceled when
+// the build is canceled or the timeout expires. A timed out command
+// is canceled like a canceled build, its OnCancel runs, and the build
+// fails.
+func (s *BuildSession) processWithTimeout(cmd *protocol.BuildCommand) error {
+	timeout, err := cmd.TimeoutDuration()
+	if err != nil {
+		return Err("Invalid timeout of %v: %v", cmd.Name, err)
+	}
+	session := *s
+	session.cancel = make(chan bool)
+	session.done = make(chan bool)
+	timedOut := make(chan bool)
+	watching := make(chan bool)
+	go func() {
+		defer close(watching)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-s.cancel:
+			close(session.cancel)
+		case <-timer.C:
+			close(timedOut)
+			close(session.cancel)
+		case <-session.done:
+		}
+	}()
+	err = session.doProcess(cmd)
+	close(session.done)
+	<-watching
+
+	s.wd = session.wd
+	if !isClosedChan(timedOut) || s.isCanceled() {
+		s.buildStatus = session.buildStatus
+		return err
+	}
+	session.onCancel(cmd)
+	s.buildStatus = protocol.BuildFailed
+	errMsg := Sprintf("ERROR: %v timed out after %v\n", cmd.Name, timeout)
+	s.logger.Info.Printf("%v", errMsg)
+	s.ConsoleLog("%v", errMsg)
+	return Err("%v timed out after %v", cmd.Name, timeout)
+}
+
+// branch makes a session for running commands concurrently with s. It
+// writes console output to console, is canceled by cancel, and keeps
+// its own copy of environment variables and secrets.
+func (s *BuildSession) branch(console io.Writer, cancel chan bool) *BuildSession {
+	session := *s
+	session.console = stream.NopCloser(console)
+	session.secrets = stream.NewSubstituteWriter(console)
+	for k, v := range s.secrets.Substitutions {
+		session.secrets.Substitutions[k] = v
+	}
+	session.echo = stream.NewSubstituteWriter(session.secrets)
+	for k, v := range s.echo.Substitutions {
+		session.echo.Substitutions[k] = v
+	}
+	session.envs = make(map[string]string)
+	for k, v := range s.envs {
+		session.envs[k] = v
+	}
+	session.cancel = cancel
+	session.done = make(chan bool)
+	return &session
+}
+
 func (s *BuildSession) testFailed(test *protocol.BuildCommand) bool {
 	if test == nil {
 		return false
@@ -228,10 +352,13 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 		return
 	}
 	cancel := &BuildSession{
+		agent:                 s.agent,
+		logger:                s.logger,
 		buildId:               s.buildId,
 		console:               s.console,
 		artifacts:             s.artifacts,
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
+		propertyBaseURL:       s.propertyBaseURL,
 		send:        s.send,
 		envs:        s.envs,
 		secrets:     s.secrets,
@@ -257,9 +384,12 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buffer, error) {
 	var output bytes.Buffer
 	session := &BuildSession{
+		agent:                 s.agent,
+		logger:                s.logger,
 		buildId:               s.buildId,
 		artifacts:             s.artifacts,
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
+		propertyBaseURL:       s.propertyBaseURL,
 		send:        s.send,
 		envs:        s.envs,
 		secrets:     s.secrets.Filter(&output),
@@ -279,7 +409,7 @@ func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buf
 
 func (s *BuildSession) Report(jobState string) *protocol.Report {
 	return &protocol.Report{
-		AgentRuntimeInfo: GetAgentRuntimeInfo(),
+		AgentRuntimeInfo: s.agent.GetAgentRuntimeInfo(),
 		BuildId:          s.buildId,
 		JobState:         jobState,
 		Result:           s.buildStatus,
@@ -294,6 +424,22 @@ func (s *BuildSession) ReplaceEcho(name string, value interface{}) {
 	s.echo.Substitutions[name] = value
 }
 
+// Output is the console log of the build with secrets masked.
+func (s *BuildSession) Output() io.Writer {
+	return s.secrets
+}
+
+// Wd is the working directory of the command being processed.
+func (s *BuildSession) Wd() string {
+	return s.wd
+}
+
+// Canceled is closed when the build is canceled, long running
+// commands should stop once it is closed.
+func (s *BuildSession) Canceled() <-chan bool {
+	return s.cancel
+}
+
 func (s *BuildSession) Env() []string {
 	osEnv := os.Environ()
 	bsEnv := make([]string, 0, len(s.envs)+len(osEnv))
@@ -309,5 +455,5 @@ func (s *BuildSession) warn(format string, a ...interface{}) {
 }
 
 func (s *BuildSession) debugLog(format string, a ...interface{}) {
-	LogDebug(Sprintf("%v\n", format), a...)
+	s.logger.Debug.Printf(Sprintf("%v\n", format), a...)
 }
@@ -39,7 +39,7 @@ func TestEcho(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.EchoCommand("echo hello world"),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -60,7 +60,7 @@ func TestExport(t *testing.T) {
 	os.Setenv("SHOULD_EXPORT", "exec command should have this")
 	defer os.Setenv("SHOULD_EXPORT", "")
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.ExportCommand("env1", "value1", "false"),
 		protocol.ExportCommand("env2", "value2", "true"),
 		protocol.ExportCommand("env1", "value4", "false"),
@@ -96,7 +96,7 @@ func TestExecCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("echo", "abcd"))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.ExecCommand("echo", "abcd"))
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Passed", stateLog.Next())
@@ -111,7 +111,7 @@ func TestMkdirCommand(t *testing.T) {
 	defer tearDown()
 
 	wd := pipelineDir()
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.MkdirsCommand(relativePath(wd)),
 		protocol.MkdirsCommand("path/in/pipeline/dir").Setwd(relativePath(wd)),
 	)
@@ -127,7 +127,7 @@ func TestCleandirCommand(t *testing.T) {
 	defer tearDown()
 
 	wd := createTestProjectInPipelineDir()
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.CleandirCommand("test", "world2").Setwd(relativePath(wd)),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -157,7 +157,7 @@ func TestFailCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId, protocol.FailCommand("something is wrong, please fail"))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.FailCommand("something is wrong, please fail"))
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Failed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -172,7 +172,7 @@ func TestSecretCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.SecretCommand("thisissecret", "$$$$$$"),
 		protocol.SecretCommand("replacebydefaultmask"),
 		protocol.EchoCommand("hello (thisissecret)"),
@@ -192,7 +192,7 @@ func TestShouldMaskSecretInExecOutput(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.SecretCommand("thisissecret", "$$$$$$"),
 		protocol.ExecCommand("echo", "hello (thisissecret)"),
 	)
@@ -210,7 +210,7 @@ func TestReplaceAgentBuildVairables(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.EchoCommand("hello ${agent.location}"),
 		protocol.EchoCommand("hello ${agent.hostname}"),
 	)
@@ -220,7 +220,7 @@ func TestReplaceAgentBuildVairables(t *testing.T) {
 
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
-	config := GetConfig()
+	config := testAgent.Config()
 	expected := Sprintf("hello %v\nhello %v\n", config.WorkingDir, config.Hostname)
 	assert.Equal(t, expected, trimTimestamp(log))
 }
@@ -229,7 +229,7 @@ func TestReplaceDateBuildVairables(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("${date}"))
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.EchoCommand("${date}"))
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Passed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -246,7 +246,7 @@ func TestFailBuildWhenThereIsUnsupportedBuildCommand(t *testing.T) {
 	defer tearDown()
 
 	cmd := protocol.NewBuildCommand("fancy")
-	goServer.SendBuild(AgentId, buildId, cmd)
+	goServer.SendBuild(testAgent.Id(), buildId, cmd)
 	assert.Equal(t, "agent Building", stateLog.Next())
 	assert.Equal(t, "build Failed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -254,15 +254,70 @@ func TestFailBuildWhenThereIsUnsupportedBuildCommand(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	expected := Sprintf("ERROR: Unknown build command: fancy\n")
+	expected := Sprintf("ERROR: Build uses commands this agent does not support: fancy\n")
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestRejectBuildBeforeRunningAnyCommandWhenCommandTreeHasUnsupportedCommands(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		echo("should not run"),
+		protocol.CondCommand(protocol.NewBuildCommand("fancy"), echo("fancy")),
+		echo("test").SetTest(protocol.NewBuildCommand("zoo")).SetOnCancel(protocol.NewBuildCommand("fancy")),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: Build uses commands this agent does not support: fancy, zoo\n", trimTimestamp(log))
+}
+
+func TestRejectBuildThatUsesCommandMappedToNotImplemented(t *testing.T) {
+	testAgent.RegisterExecutor("unready", NotImplemented)
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		echo("should not run"),
+		protocol.NewBuildCommand("unready"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: Build uses commands this agent does not support: unready\n", trimTimestamp(log))
+	assert.False(t, containsString(testAgent.SupportedCommands(), "unready"))
+}
+
+func TestRuntimeInfoAdvertisesProtocolVersionAndSupportedCommands(t *testing.T) {
+	info := testAgent.GetAgentRuntimeInfo()
+	assert.Equal(t, protocol.BuildCommandProtocolVersion, info.ProtocolVersion)
+	assert.True(t, containsString(info.SupportedCommands, protocol.CommandExec))
+	assert.True(t, containsString(info.SupportedCommands, protocol.CommandGenerateTestReport))
+	assert.True(t, containsString(info.SupportedCommands, protocol.CommandGenerateProperty))
+	assert.True(t, containsString(info.Features, protocol.FeatureCrashRecovery))
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 func TestShouldFailBuildIfWorkingDirIsSetToOutsideOfAgentWorkingDir(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		echo("echo hello world").Setwd("../../../"),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -274,7 +329,7 @@ func TestShouldFailBuildIfWorkingDirDoesNotExist(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		echo("echo hello world").Setwd("notexist/subdir"),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -284,7 +339,7 @@ func TestShouldFailBuildIfWorkingDirDoesNotExist(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	config := GetConfig()
+	config := testAgent.Config()
 	expected := Sprintf("ERROR: Working directory \"%v/%v\" is not a directory\n", config.WorkingDir, "notexist/subdir")
 	assert.Equal(t, expected, trimTimestamp(log))
 }
@@ -293,14 +348,14 @@ func TestReportStatusAndCompleting(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.ReportCurrentStatusCommand("Preparing"),
 		protocol.ReportCurrentStatusCommand("Building"),
 		protocol.ReportCompletingCommand(),
 	)
 
 	assert.Equal(t, "agent Building", stateLog.Next())
-	assert.NotEqual(t, "", GetState("cookie"))
+	assert.NotEqual(t, "", testAgent.GetState("cookie"))
 
 	assert.Equal(t, "build Preparing", stateLog.Next())
 	assert.Equal(t, "build Building", stateLog.Next())
@@ -344,7 +399,7 @@ func TestTestCommand(t *testing.T) {
 
 	for _, test := range tests {
 		testCmd := protocol.TestCommand(test.testArgs...).Setwd(relativePath(wd))
-		goServer.SendBuild(AgentId, buildId, protocol.CondCommand(testCmd, echo(test.echo)))
+		goServer.SendBuild(testAgent.Id(), buildId, protocol.CondCommand(testCmd, echo(test.echo)))
 		assert.Equal(t, "agent Building", stateLog.Next())
 		assert.Equal(t, "build Passed", stateLog.Next())
 		assert.Equal(t, "agent Idle", stateLog.Next())
@@ -365,7 +420,7 @@ func TestTestCommandEchoShouldAlsoBeMaskedForSecrets(t *testing.T) {
 	defer tearDown()
 
 	testCmd := protocol.TestCommand("-eq", "$$$", "echo", "secret")
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.SecretCommand("secret", "$$$"),
 		protocol.EchoCommand("hello world").SetTest(testCmd),
 	)
@@ -386,7 +441,7 @@ func TestGenerateTestReportFromNunit2xTestResultsReport(t *testing.T) {
 	copyTestReports(filepath.Join(wd, "reports"), "nunit", "nunit2x_report1.xml")
 	copyTestReports(filepath.Join(wd, "reports"), "nunit", "nunit2x_report2.xml")
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.GenerateTestReportCommand("testoutput", "reports/nunit2x_report1.xml", "reports/nunit2x_report1.xml").Setwd(relativePath(wd)),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -406,7 +461,7 @@ func TestGenerateTestReportFromTestSuiteReports(t *testing.T) {
 	copyTestReports(filepath.Join(wd, "reports"), "junit", "junit_report1.xml")
 	copyTestReports(filepath.Join(wd, "reports"), "junit", "junit_report2.xml")
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.GenerateTestReportCommand("testoutput", "reports/junit_report1.xml", "reports/junit_report2.xml").Setwd(relativePath(wd)),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -425,7 +480,7 @@ func TestGenerateTestReportFromTestSuitesReport(t *testing.T) {
 	wd := createTestProjectInPipelineDir()
 	copyTestReports(filepath.Join(wd, "reports"), "junit", "junit_report3.xml")
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.GenerateTestReportCommand("testoutput", "reports/junit_report3.xml").Setwd(relativePath(wd)),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -444,7 +499,7 @@ func TestDoNothingIfGenerateTestReportSrcsIsEmpty(t *testing.T) {
 	wd := createTestProjectInPipelineDir()
 	copyTestReports(filepath.Join(wd, "reports"), "junit", "junit_report3.xml")
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.GenerateTestReportCommand("testoutput").Setwd(relativePath(wd)),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -530,7 +585,7 @@ type TestRow struct {
 
 func verify(t *testing.T, testRows []TestRow) {
 	for _, row := range testRows {
-		goServer.SendBuild(AgentId, buildId, row.command)
+		goServer.SendBuild(testAgent.Id(), buildId, row.command)
 		assert.Equal(t, "agent Building", stateLog.Next())
 		assert.Equal(t, "build "+row.result, stateLog.Next())
 		assert.Equal(t, "agent Idle", stateLog.Next())
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// BuildState is kept in BuildStateFile while a build is running, so
+// that an agent restarted after a crash can fail the build on Go server
+// and kill the processes the build left behind.
+type BuildState struct {
+	BuildId                string         `json:"buildId"`
+	BuildLocator           string         `json:"buildLocator"`
+	BuildLocatorForDisplay string         `json:"buildLocatorForDisplay"`
+	ConsoleUrl             string         `json:"consoleUrl"`
+	Processes              []BuildProcess `json:"processes"`
+}
+
+// BuildProcess is a process started by the build. StartTime tells it
+// from a later process that reuses its pid.
+type BuildProcess struct {
+	Pid       int    `json:"pid"`
+	StartTime string `json:"startTime"`
+}
+
+// ProcessStartTime reads start time of process pid from /proc, or asks
+// ps where there is no /proc. It fails when there is no such process.
+func ProcessStartTime(pid int) (string, error) {
+	data, err := ioutil.ReadFile(Sprintf("/proc/%v/stat", pid))
+	if err == nil {
+		// fields are counted after the command name, which may contain
+		// spaces; starttime is the 22nd field of stat
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 20 {
+			return "", Err("unexpected /proc/%v/stat: %v", pid, stat)
+		}
+		bootId, _ := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+		return strings.TrimSpace(string(bootId)) + ":" + fields[19], nil
+	}
+	if _, procErr := os.Stat("/proc/self/stat"); procErr == nil {
+		return "", err
+	}
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", Err("no process %v: %v", pid, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ReadBuildState returns nil when there is no build state file.
+func ReadBuildState(path string) (*BuildState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state BuildState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, Err("%v is invalid: %v", path, err)
+	}
+	return &state, nil
+}
+
+func (b *BuildState) Write(path string) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (a *Agent) saveBuildState(state *BuildState) {
+	a.buildStateMu.Lock()
+	defer a.buildStateMu.Unlock()
+	a.buildState = state
+	a.writeBuildState()
+}
+
+// clearBuildState removes the state of build buildId. A build that
+// is still completing after the next one started leaves the state of
+// the next build alone.
+func (a *Agent) clearBuildState(buildId string) {
+	a.buildStateMu.Lock()
+	defer a.buildStateMu.Unlock()
+	if a.buildState != nil && a.buildState.BuildId != buildId {
+		return
+	}
+	a.buildState = nil
+	if err := os.Remove(a.Config().BuildStateFile); err != nil && !os.IsNotExist(err) {
+		a.logger.Error.Printf("remove build state failed: %v", err)
+	}
+}
+
+func (a *Agent) addBuildProcess(pid int) {
+	startTime, err := ProcessStartTime(pid)
+	if err != nil {
+		a.logger.Warn.Printf("read start time of process %v failed: %v", pid, err)
+	}
+	a.buildStateMu.Lock()
+	defer a.buildStateMu.Unlock()
+	if a.buildState != nil {
+		a.buildState.Processes = append(a.buildState.Processes, BuildProcess{Pid: pid, StartTime: startTime})
+		a.writeBuildState()
+	}
+}
+
+func (a *Agent) removeBuildProcess(pid int) {
+	a.buildStateMu.Lock()
+	defer a.buildStateMu.Unlock()
+	if a.buildState == nil {
+		return
+	}
+	for i, p := range a.buildState.Processes {
+		if p.Pid == pid {
+			a.buildState.Processes = append(a.buildState.Processes[:i], a.buildState.Processes[i+1:]...)
+			a.writeBuildState()
+			return
+		}
+	}
+}
+
+func (a *Agent) writeBuildState() {
+	if a.buildState == nil {
+		return
+	}
+	if err := a.buildState.Write(a.Config().BuildStateFile); err != nil {
+		a.logger.Error.Printf("save build state failed: %v", err)
+	}
+}
+
+// recoverBuildState kills processes of the build that was running when
+// agent stopped last time, and keeps the build to report it failed
+// once agent is connected. A process is only killed when it started
+// at the recorded time, its pid may have been reused by now.
+func (a *Agent) recoverBuildState() {
+	state, err := ReadBuildState(a.Config().BuildStateFile)
+	if err != nil {
+		a.logger.Error.Printf("read build state failed: %v", err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	a.logger.Warn.Printf("build %v was running when agent stopped last time", state.BuildId)
+	for _, process := range state.Processes {
+		startTime, err := ProcessStartTime(process.Pid)
+		if err != nil {
+			continue
+		}
+		if process.StartTime == "" || startTime != process.StartTime {
+			a.logger.Info.Printf("process %v is not the one build started, leave it running", process.Pid)
+			continue
+		}
+		if p, err := os.FindProcess(process.Pid); err == nil {
+			if err := p.Kill(); err == nil {
+				a.logger.Info.Printf("killed orphaned process %v", process.Pid)
+			}
+		}
+	}
+	a.crashedBuild = state
+}
+
+func (a *Agent) reportCrashedBuild(httpClient *http.Client, send chan *protocol.Message) error {
+	state := a.crashedBuild
+	if state == nil {
+		return nil
+	}
+	curl, err := a.Config().MakeFullServerURL(state.ConsoleUrl)
+	if err != nil {
+		return err
+	}
+	console := MakeBuildConsole(httpClient, curl, a.logger, a.id)
+	console.Write([]byte("ERROR: agent crashed while running this build, the build is failed\n"))
+	console.Close()
+	send <- protocol.CompletedMessage(&protocol.Report{
+		AgentRuntimeInfo: a.GetAgentRuntimeInfo(),
+		BuildId:          state.BuildId,
+		Result:           protocol.BuildFailed,
+	})
+	a.logger.Info.Printf("reported build %v failed", state.BuildId)
+	a.crashedBuild = nil
+	a.clearBuildState(state.BuildId)
+	return nil
+}
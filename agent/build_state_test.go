@@ -0,0 +1,176 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildStateIsClearedAfterBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.ExecCommand("sleep", "1"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	time.Sleep(100 * time.Millisecond)
+	state, err := ReadBuildState(testAgent.Config().BuildStateFile)
+	assert.Nil(t, err)
+	assert.NotNil(t, state)
+	assert.Equal(t, buildId, state.BuildId)
+	assert.Equal(t, 1, len(state.Processes))
+	assert.NotEqual(t, "", state.Processes[0].StartTime)
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	state, err = ReadBuildState(testAgent.Config().BuildStateFile)
+	assert.Nil(t, err)
+	assert.True(t, state == nil)
+}
+
+var slowConsoleOnce sync.Once
+
+func TestBuildStateOfNextBuildIsKeptWhilePreviousBuildIsCompleting(t *testing.T) {
+	// uploading console log of the previous build keeps it completing
+	// after it is canceled for the next build
+	slowConsoleOnce.Do(func() {
+		goServer.HandleFunc("/slow-console/", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		})
+	})
+	setUp(t)
+	defer tearDown()
+
+	locator := "/builds/" + buildId + "-previous"
+	previous := protocol.NewBuild(buildId+"-previous", locator, locator,
+		"/slow-console"+locator,
+		server.ArtifactsPath+locator,
+		server.PropertiesPath+locator,
+		echo("started"),
+		protocol.ExecCommand("sleep", "5"))
+	goServer.Send(testAgent.Id(), protocol.BuildMessage(previous))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.ExecCommand("sleep", "2"))
+	passed := make(chan bool)
+	go func() {
+		defer close(passed)
+		for i := 0; i < 10 && stateLog.Next() != "build Passed"; i++ {
+		}
+	}()
+
+	time.Sleep(time.Second)
+	state, err := ReadBuildState(testAgent.Config().BuildStateFile)
+	assert.Nil(t, err)
+	assert.NotNil(t, state)
+	assert.Equal(t, buildId, state.BuildId)
+	assert.Equal(t, 1, len(state.Processes))
+	<-passed
+}
+
+func TestRestartedAgentFailsBuildItCrashedIn(t *testing.T) {
+	orphan, killed := startOrphan(t)
+	startTime, err := ProcessStartTime(orphan.Process.Pid)
+	assert.Nil(t, err)
+	a := newCrashedAgent(t, BuildProcess{Pid: orphan.Process.Pid, StartTime: startTime})
+	defer removeTestAgents([]*Agent{a})
+	select {
+	case <-killed:
+		t.Fatal("orphaned process is killed before agent starts")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	stopped := startCrashedAgent(t, a)
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		orphan.Process.Kill()
+		t.Fatal("orphaned process is not killed")
+	}
+	goServer.Send(a.Id(), protocol.ReregisterMessage())
+	<-stopped
+}
+
+func TestRestartedAgentDoesNotKillProcessThatReusedPid(t *testing.T) {
+	other, killed := startOrphan(t)
+	defer other.Process.Kill()
+	a := newCrashedAgent(t, BuildProcess{Pid: other.Process.Pid, StartTime: "started before reboot"})
+	defer removeTestAgents([]*Agent{a})
+
+	stopped := startCrashedAgent(t, a)
+	goServer.Send(a.Id(), protocol.ReregisterMessage())
+	<-stopped
+	select {
+	case <-killed:
+		t.Fatal("process that reused pid is killed")
+	default:
+	}
+}
+
+func startOrphan(t *testing.T) (*exec.Cmd, chan error) {
+	orphan := exec.Command("sleep", "30")
+	assert.Nil(t, orphan.Start())
+	killed := make(chan error, 1)
+	go func() {
+		killed <- orphan.Wait()
+	}()
+	return orphan, killed
+}
+
+func newCrashedAgent(t *testing.T, processes ...BuildProcess) *Agent {
+	buildId = callerName(2)
+	config := *testAgent.Config()
+	config.AgentCount = 2
+	c := config.AgentConfigs()[1]
+	assert.Nil(t, Mkdirs(c.ConfigDir))
+	crashed := &BuildState{
+		BuildId:    buildId,
+		ConsoleUrl: server.ConsoleLogPath + "/builds/" + buildId,
+		Processes:  processes,
+	}
+	assert.Nil(t, crashed.Write(c.BuildStateFile))
+	a, err := NewAgent(c)
+	assert.Nil(t, err)
+	return a
+}
+
+// startCrashedAgent starts agent and waits until it reported the build
+// it crashed in failed.
+func startCrashedAgent(t *testing.T, a *Agent) chan bool {
+	stateLog.Reset(buildId, a.Id())
+	stopped := make(chan bool)
+	go func() {
+		a.Start()
+		close(stopped)
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: agent crashed while running this build, the build is failed\n", trimTimestamp(log))
+	_, err = os.Stat(a.Config().BuildStateFile)
+	assert.True(t, os.IsNotExist(err))
+	return stopped
+}
@@ -22,7 +22,7 @@ import (
 )
 
 func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error {
-	checksumURL, err := config.MakeFullServerURL(cmd.Args["checksumUrl"])
+	checksumURL, err := s.agent.Config().MakeFullServerURL(cmd.Args["checksumUrl"])
 	if err != nil {
 		return err
 	}
@@ -32,7 +32,7 @@ func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error
 		return err
 	}
 
-	srcURL, err := config.MakeFullServerURL(cmd.Args["url"])
+	srcURL, err := s.agent.Config().MakeFullServerURL(cmd.Args["url"])
 	if err != nil {
 		return err
 	}
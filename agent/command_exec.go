@@ -31,21 +31,33 @@ func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
 	execCmd.Stdout = s.secrets
 	execCmd.Stderr = s.secrets
 	execCmd.Dir = s.wd
+	return runProcess(s, execCmd, cmd.Args)
+}
+
+// runProcess runs execCmd and kills it once the build is canceled,
+// desc names the process in logs.
+func runProcess(s *BuildSession, execCmd *exec.Cmd, desc interface{}) error {
+	if err := execCmd.Start(); err != nil {
+		return err
+	}
+	pid := execCmd.Process.Pid
+	s.agent.addBuildProcess(pid)
+	defer s.agent.removeBuildProcess(pid)
 	done := make(chan error)
 	go func() {
-		done <- execCmd.Run()
+		done <- execCmd.Wait()
 	}()
 
 	select {
 	case <-s.cancel:
 		s.debugLog("received cancel signal")
-		LogInfo("kill process(%v) %v", execCmd.Process, cmd.Args)
+		s.logger.Info.Printf("kill process(%v) %v", pid, desc)
 		if err := execCmd.Process.Kill(); err != nil {
-			s.ConsoleLog("Kill command %v failed, error: %v\n", cmd.Args, err)
+			s.ConsoleLog("Kill command %v failed, error: %v\n", desc, err)
 		} else {
-			LogInfo("process %v is killed", execCmd.Process)
+			s.logger.Info.Printf("process %v is killed", pid)
 		}
-		return Err("%v is canceled", cmd.Args)
+		return Err("%v is canceled", desc)
 	case err := <-done:
 		return err
 	}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"github.com/bmatcuk/doublestar"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CommandForeach processes its only sub command once per item. Items
+// come from exactly one of the args "items" (a list), "glob" (a
+// doublestar pattern matched in the working directory, items are the
+// relative paths) and "file" (non-blank lines of the file). The item
+// is exported as environment variable "var", ITEM by default, and
+// replaces ${var} in echo output. Iterations run one by one and stop
+// at the first failing one, or in parallel like the parallel command
+// when "maxConcurrency" is 0 (all at once) or greater than 1.
+func CommandForeach(s *BuildSession, cmd *protocol.BuildCommand) error {
+	if len(cmd.SubCommands) != 1 {
+		return Err("foreach needs exactly one sub command, got %v", len(cmd.SubCommands))
+	}
+	items, err := foreachItems(s, cmd)
+	if err != nil {
+		return err
+	}
+	name := cmd.Args["var"]
+	if name == "" {
+		name = "ITEM"
+	}
+	maxConcurrency, err := maxConcurrencyArg(cmd, 1, len(items))
+	if err != nil {
+		return err
+	}
+	body := cmd.SubCommands[0]
+	if maxConcurrency > 1 {
+		bodies := make([]*protocol.BuildCommand, len(items))
+		for i := range bodies {
+			bodies[i] = body
+		}
+		return s.processParallel(bodies, items, maxConcurrency, cmd.Args["failFast"] == "true", func(i int, branch *BuildSession) {
+			branch.envs[name] = items[i]
+			branch.ReplaceEcho("${"+name+"}", items[i])
+		})
+	}
+
+	env, exported := s.envs[name]
+	echo, replaced := s.echo.Substitutions["${"+name+"}"]
+	defer func() {
+		if exported {
+			s.envs[name] = env
+		} else {
+			delete(s.envs, name)
+		}
+		if replaced {
+			s.ReplaceEcho("${"+name+"}", echo)
+		} else {
+			delete(s.echo.Substitutions, "${"+name+"}")
+		}
+	}()
+	status := s.buildStatus
+	for _, item := range items {
+		s.envs[name] = item
+		s.ReplaceEcho("${"+name+"}", item)
+		err = s.process(body)
+		if err != nil || s.isCanceled() || status != protocol.BuildFailed && s.buildStatus == protocol.BuildFailed {
+			break
+		}
+	}
+	return err
+}
+
+func foreachItems(s *BuildSession, cmd *protocol.BuildCommand) ([]string, error) {
+	sources := 0
+	for _, arg := range []string{"items", "glob", "file"} {
+		if _, ok := cmd.Args[arg]; ok {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, Err("foreach needs exactly one of items, glob and file")
+	}
+	if _, ok := cmd.Args["items"]; ok {
+		return cmd.ListArg("items")
+	}
+	if pattern, ok := cmd.Args["glob"]; ok {
+		matches, err := doublestar.Glob(filepath.Join(escapeGlob(s.wd), pattern))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		items := make([]string, len(matches))
+		for i, match := range matches {
+			if items[i], err = filepath.Rel(s.wd, match); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	f, err := os.Open(filepath.Join(s.wd, cmd.Args["file"]))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var items []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items, scanner.Err()
+}
+
+// escapeGlob makes glob syntax in path match literally.
+func escapeGlob(path string) string {
+	var escaped strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[]{}\`, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
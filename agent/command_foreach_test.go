@@ -0,0 +1,106 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestForeachCommandOverListItems(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	body := protocol.ComposeCommand(
+		echo("echo ${ITEM}"),
+		protocol.ExecCommand("sh", "-c", "echo env $ITEM"))
+	verify(t, []TestRow{
+		{protocol.ComposeCommand(
+			protocol.ForeachCommand([]string{"a", "b"}, body),
+			echo("after ${ITEM}")),
+			"echo a\nenv a\necho b\nenv b\nafter ${ITEM}\n", "Passed"},
+		{protocol.ForeachCommand([]string{"a", "b", "c"},
+			protocol.ExecCommand("sh", "-c", "echo $MODULE; [ $MODULE != b ]")).AddArg("var", "MODULE"),
+			"a\nb\nERROR: exit status 1\n", "Failed"},
+		{protocol.ForeachCommand([]string{"a", "b", "c"},
+			protocol.ComposeCommand(
+				protocol.ExecCommand("sh", "-c", "echo $ITEM; [ $ITEM != b ]"),
+				echo("after ${ITEM}").RunIf("any")).RunIf("any")),
+			"a\nafter a\nb\nERROR: exit status 1\nafter b\n", "Failed"},
+		{protocol.ForeachCommand([]string{}, echo("never")),
+			"", "Passed"},
+		{protocol.ForeachCommand([]string{"a"}, echo("never")).AddArg("glob", "*"),
+			"ERROR: foreach needs exactly one of items, glob and file\n", "Failed"},
+	})
+}
+
+func TestForeachCommandOverGlobMatchesAndFileLines(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	for _, module := range []string{"b", "a", "c/nested"} {
+		assert.Nil(t, writeFile(filepath.Join(wd, "modules", module), "build.gradle", "apply plugin: 'java'"))
+	}
+	assert.Nil(t, writeFile(wd, "modules.txt", "a\n\n  b  \n"))
+
+	verify(t, []TestRow{
+		{protocol.NewBuildCommand(protocol.CommandForeach).
+			AddArg("glob", "modules/**/build.gradle").
+			AddCommands(echo("${ITEM}")).
+			Setwd(relativePath(wd)),
+			"modules/a/build.gradle\nmodules/b/build.gradle\nmodules/c/nested/build.gradle\n", "Passed"},
+		{protocol.NewBuildCommand(protocol.CommandForeach).
+			AddArg("file", "modules.txt").
+			AddCommands(protocol.ExecCommand("sh", "-c", "ls modules/$ITEM").Setwd(relativePath(wd))).
+			Setwd(relativePath(wd)),
+			"build.gradle\nbuild.gradle\n", "Passed"},
+	})
+}
+
+func TestForeachCommandGlobsInWorkingDirWithGlobSyntaxInItsName(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := filepath.Join(createPipelineDir(), "odd[1]*")
+	assert.Nil(t, writeFile(wd, "a.txt", "a"))
+	assert.Nil(t, writeFile(wd, "b.txt", "b"))
+
+	verify(t, []TestRow{
+		{protocol.NewBuildCommand(protocol.CommandForeach).
+			AddArg("glob", "*.txt").
+			AddCommands(echo("${ITEM}")).
+			Setwd(relativePath(wd)),
+			"a.txt\nb.txt\n", "Passed"},
+	})
+}
+
+func TestForeachCommandRunsIterationsInParallel(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.ForeachCommand([]string{"a", "b", "c"},
+			protocol.ExecCommand("sh", "-c", "sleep 0.1; echo module $ITEM")).AddArg("maxConcurrency", "0"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, []string{
+		"[a] module a",
+		"[b] module b",
+		"[c] module c",
+	}, sortedConsoleLines(t))
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// CommandGenerateProperty evaluates the XPath expression "xpath"
+// against XML file "src" and sets the result as build property
+// "name". Like the Java agent, failures are reported in the console
+// log without failing the build.
+func CommandGenerateProperty(s *BuildSession, cmd *protocol.BuildCommand) error {
+	name := cmd.Args["name"]
+	expr := cmd.Args["xpath"]
+	file := filepath.Join(s.wd, cmd.Args["src"])
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		s.ConsoleLog("Failed to create property %v. File %v does not exist.\n", name, file)
+		return nil
+	}
+	compiled, err := xpath.Compile(expr)
+	if err != nil {
+		s.propertyFailed(name, Sprintf("Illegal xpath: \"%v\"", expr), err)
+		return nil
+	}
+	value, matched, err := evaluateXPath(file, compiled)
+	if err != nil {
+		s.propertyFailed(name, err.Error(), err)
+		return nil
+	}
+	if !matched {
+		s.ConsoleLog("Failed to create property %v. Nothing matched xpath \"%v\" in the file: %v.\n", name, expr, file)
+		return nil
+	}
+	if err := s.artifacts.SetProperty(s.propertyBaseURL, name, value); err != nil {
+		s.propertyFailed(name, err.Error(), err)
+		return nil
+	}
+	s.ConsoleLog("Property %v = %v created.\n", name, value)
+	return nil
+}
+
+func (s *BuildSession) propertyFailed(name, reason string, err error) {
+	s.logger.Error.Printf("generate property %v failed: %v", name, err)
+	s.ConsoleLog("Failed to create property %v. %v\n", name, reason)
+}
+
+// evaluateXPath returns the string value of expr in file. Only an
+// empty node set or empty string does not match, a number or boolean
+// result always does, even 0 or false.
+func evaluateXPath(file string, expr *xpath.Expr) (value string, matched bool, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	doc, err := xmlquery.Parse(f)
+	if err != nil {
+		return "", false, err
+	}
+	switch v := expr.Evaluate(xmlquery.CreateXPathNavigator(doc)).(type) {
+	case *xpath.NodeIterator:
+		if !v.MoveNext() {
+			return "", false, nil
+		}
+		return v.Current().Value(), true, nil
+	case string:
+		return v, v != "", nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true, nil
+	case bool:
+		return strconv.FormatBool(v), true, nil
+	default:
+		return "", false, Err("unexpected xpath result: %v", v)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"path/filepath"
+	"testing"
+)
+
+const coverageReport = `<?xml version="1.0"?>
+<coverage line-rate="0.85">
+  <tests>
+    <test name="a"/>
+    <test name="b"/>
+    <test name="c"/>
+  </tests>
+</coverage>`
+
+func TestGenerateProperty(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(wd, "coverage.xml", coverageReport))
+	property := func(name, src, xpath string) *protocol.BuildCommand {
+		return protocol.GeneratePropertyCommand(name, src, xpath).Setwd(relativePath(wd))
+	}
+
+	verify(t, []TestRow{
+		{property("coverage", "coverage.xml", "/coverage/@line-rate"),
+			"Property coverage = 0.85 created.\n", "Passed"},
+		{property("tests", "coverage.xml", "count(//test)"),
+			"Property tests = 3 created.\n", "Passed"},
+		{property("suites", "coverage.xml", "count(//suite)"),
+			"Property suites = 0 created.\n", "Passed"},
+		{property("untested", "coverage.xml", "count(//test)=0"),
+			"Property untested = false created.\n", "Passed"},
+		{property("missing", "missing.xml", "//test"),
+			Sprintf("Failed to create property missing. File %v does not exist.\n", filepath.Join(wd, "missing.xml")), "Passed"},
+		{property("nothing", "coverage.xml", "//suite"),
+			Sprintf("Failed to create property nothing. Nothing matched xpath \"//suite\" in the file: %v.\n", filepath.Join(wd, "coverage.xml")), "Passed"},
+		{property("illegal", "coverage.xml", "//["),
+			"Failed to create property illegal. Illegal xpath: \"//[\"\n", "Passed"},
+		{property("coverage", "coverage.xml", "//test/@name"),
+			"Failed to create property coverage. Server response: 409 Property 'coverage' is already set.\n", "Passed"},
+	})
+
+	value, err := goServer.Property(buildId, "coverage")
+	assert.Nil(t, err)
+	assert.Equal(t, "0.85", value)
+	value, err = goServer.Property(buildId, "tests")
+	assert.Nil(t, err)
+	assert.Equal(t, "3", value)
+	value, err = goServer.Property(buildId, "suites")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", value)
+	value, err = goServer.Property(buildId, "untested")
+	assert.Nil(t, err)
+	assert.Equal(t, "false", value)
+	_, err = goServer.Property(buildId, "nothing")
+	assert.NotNil(t, err)
+}
+
+func TestGeneratePropertyReportsInvalidXml(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(wd, "broken.xml", "<coverage><tests></coverage>"))
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.GeneratePropertyCommand("broken", "broken.xml", "//tests").Setwd(relativePath(wd)),
+		echo("build goes on"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(trimTimestamp(log), "Failed to create property broken. "))
+	assert.True(t, contains(trimTimestamp(log), "build goes on\n"))
+}
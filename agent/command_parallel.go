@@ -0,0 +1,129 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"strconv"
+	"sync"
+)
+
+// CommandParallel processes its sub commands concurrently, at most
+// "maxConcurrency" of them at a time, all of them by default. Console
+// output of sub command i is written line by line, prefixed by "[i] ".
+// With "failFast", the first failing sub command cancels the others.
+// Every sub command works on its own copy of environment variables and
+// secrets.
+func CommandParallel(s *BuildSession, cmd *protocol.BuildCommand) error {
+	maxConcurrency, err := maxConcurrencyArg(cmd, len(cmd.SubCommands), len(cmd.SubCommands))
+	if err != nil {
+		return err
+	}
+	labels := make([]string, len(cmd.SubCommands))
+	for i := range labels {
+		labels[i] = strconv.Itoa(i + 1)
+	}
+	return s.processParallel(cmd.SubCommands, labels, maxConcurrency, cmd.Args["failFast"] == "true", nil)
+}
+
+// maxConcurrencyArg reads "maxConcurrency" of cmd, 0 means all.
+func maxConcurrencyArg(cmd *protocol.BuildCommand, defaultValue, all int) (int, error) {
+	v, ok := cmd.Args["maxConcurrency"]
+	if !ok {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, Err("Invalid %v maxConcurrency: %v", cmd.Name, v)
+	}
+	if n == 0 || n > all {
+		return all, nil
+	}
+	return n, nil
+}
+
+// processParallel processes commands concurrently, each in its own
+// branch of s that prefixes console output and log entries with its
+// label. prepare, when given, sets up branch i before it runs.
+func (s *BuildSession) processParallel(commands []*protocol.BuildCommand, labels []string, maxConcurrency int, failFast bool, prepare func(i int, branch *BuildSession)) error {
+	status := s.buildStatus
+	cancel := make(chan bool)
+	failed := make(chan bool)
+	var failOnce sync.Once
+	finished := make(chan bool)
+	watching := make(chan bool)
+	go func() {
+		defer close(watching)
+		select {
+		case <-s.cancel:
+		case <-failed:
+		case <-finished:
+			return
+		}
+		close(cancel)
+	}()
+
+	var consoleMu sync.Mutex
+	slots := make(chan bool, maxConcurrency)
+	branches := make([]*BuildSession, len(commands))
+	var wg sync.WaitGroup
+	for i, sub := range commands {
+		label := labels[i]
+		prefix := []byte(Sprintf("[%v] ", label))
+		output := stream.NewLineWriter(s.console, &consoleMu)
+		branch := s.branch(stream.NewPrefixWriter(output, func() []byte { return prefix }), cancel)
+		branch.logger = branch.logger.With("branch", label)
+		if prepare != nil {
+			prepare(i, branch)
+		}
+		branches[i] = branch
+		wg.Add(1)
+		slots <- true
+		go func(sub *protocol.BuildCommand) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer output.Flush()
+			branch.process(sub)
+			if branch.buildStatus == protocol.BuildFailed && failFast {
+				failOnce.Do(func() {
+					consoleMu.Lock()
+					s.warn("[%v] failed, cancel other parallel commands.", label)
+					consoleMu.Unlock()
+					close(failed)
+				})
+			}
+		}(sub)
+	}
+	wg.Wait()
+	close(finished)
+	<-watching
+
+	if s.isCanceled() || status == protocol.BuildFailed {
+		return nil
+	}
+	count := 0
+	for _, branch := range branches {
+		if branch.buildStatus == protocol.BuildFailed {
+			count++
+		}
+	}
+	if count > 0 {
+		return Err("%v of %v parallel commands failed", count, len(branches))
+	}
+	return nil
+}
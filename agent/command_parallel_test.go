@@ -0,0 +1,195 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelCommandPrefixesOutputOfEachSubCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	slowLine := protocol.ExecCommand("sh", "-c", "printf hello; sleep 0.1; printf ' world\\nbye'")
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.ParallelCommand(slowLine, slowLine, echo("echo")))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, []string{
+		"[1] bye",
+		"[1] hello world",
+		"[2] bye",
+		"[2] hello world",
+		"[3] echo",
+	}, sortedConsoleLines(t))
+}
+
+func TestParallelCommandLimitsConcurrency(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	verify(t, []TestRow{
+		{protocol.ParallelCommand(
+			protocol.ExecCommand("sh", "-c", "sleep 0.1; echo one"),
+			echo("two"),
+		).AddArg("maxConcurrency", "1"),
+			"[1] one\n[2] two\n", "Passed"},
+		{protocol.ParallelCommand(echo("one")).AddArg("maxConcurrency", "many"),
+			"ERROR: Invalid parallel maxConcurrency: many\n", "Failed"},
+	})
+}
+
+func TestParallelCommandFailsWhenAnySubCommandFails(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.ParallelCommand(
+			protocol.FailCommand("boom"),
+			protocol.ExecCommand("sh", "-c", "sleep 0.2; echo still running"),
+		),
+		echo("skipped"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, []string{
+		"ERROR: 1 of 2 parallel commands failed",
+		"[1] ERROR: boom",
+		"[2] still running",
+	}, sortedConsoleLines(t))
+}
+
+func TestParallelCommandFailFastCancelsSiblings(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	start := time.Now()
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sh", "-c", "sleep 0.1; exit 1"),
+			protocol.ExecCommand("sleep", "5").SetOnCancel(echo("canceled")),
+		).AddArg("failFast", "true"),
+		echo("always").RunIf("any"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.True(t, time.Since(start) < 3*time.Second)
+
+	assert.Equal(t, []string{
+		"ERROR: 1 of 2 parallel commands failed",
+		"WARN: [1] failed, cancel other parallel commands.",
+		"[1] ERROR: exit status 1",
+		"[2] canceled",
+		"always",
+	}, sortedConsoleLines(t))
+}
+
+func TestParallelCommandLogsFieldsOfEachBranch(t *testing.T) {
+	config := *testAgent.Config()
+	config.AgentCount = 2
+	a, err := NewAgent(config.AgentConfigs()[1])
+	assert.Nil(t, err)
+	defer removeTestAgents([]*Agent{a})
+	var logs lockedBuffer
+	a.SetLogger(NewLogger(LogOptions{Output: &logs, Level: LevelInfo, Format: LogFormatJSON}))
+
+	buildId = callerName(1)
+	stateLog.Reset(buildId, a.Id())
+	stopped := make(chan bool)
+	go func() {
+		a.Start()
+		close(stopped)
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	goServer.SendBuild(a.Id(), buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sh", "-c", "sleep 0.1; exit 1"),
+			protocol.ExecCommand("sleep", "5"),
+			protocol.ExecCommand("sleep", "5"),
+		).AddArg("failFast", "true"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	goServer.Send(a.Id(), protocol.ReregisterMessage())
+	<-stopped
+
+	var killed []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]string
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		if strings.HasPrefix(entry["msg"], "kill process") {
+			assert.Equal(t, protocol.CommandExec, entry["command"])
+			assert.Equal(t, buildId, entry["buildId"])
+			killed = append(killed, entry["branch"])
+		}
+	}
+	sort.Strings(killed)
+	assert.Equal(t, []string{"2", "3"}, killed)
+}
+
+func TestCancelBuildRunningParallelCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sleep", "5"),
+			protocol.ExecCommand("sleep", "5").SetOnCancel(echo("canceled")),
+		),
+		echo("should not process this echo"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	time.Sleep(100 * time.Millisecond)
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, []string{"[2] canceled"}, sortedConsoleLines(t))
+}
+
+func sortedConsoleLines(t *testing.T) []string {
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(trimTimestamp(log), "\n"), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+// lockedBuffer is a bytes.Buffer that agent goroutines can keep writing
+// to while a test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
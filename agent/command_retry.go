@@ -0,0 +1,91 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"strconv"
+	"time"
+)
+
+// CommandRetry processes its only sub command again after it failed,
+// up to "attempts" times. It waits "delay" before the first retry and
+// "backoff" times longer before each following one. The build only
+// fails when the last attempt fails. An attempt fails when it returns
+// an error or turns the build status it started with into failed, so
+// a retry that runs in an already failed build is judged on its own.
+func CommandRetry(s *BuildSession, cmd *protocol.BuildCommand) error {
+	if len(cmd.SubCommands) != 1 {
+		return Err("retry needs exactly one sub command, got %v", len(cmd.SubCommands))
+	}
+	attempts, delay, backoff, err := retryArgs(cmd)
+	if err != nil {
+		return err
+	}
+	sub := cmd.SubCommands[0]
+	status := s.buildStatus
+	for attempt := 1; ; attempt++ {
+		err = s.process(sub)
+		if s.isCanceled() {
+			return err
+		}
+		failed := err != nil || status != protocol.BuildFailed && s.buildStatus == protocol.BuildFailed
+		if !failed {
+			if attempt > 1 {
+				s.ConsoleLog("Attempt %v of %v passed.\n", attempt, attempts)
+			}
+			return nil
+		}
+		if attempt == attempts {
+			if attempts > 1 {
+				s.ConsoleLog("Gave up after %v attempts.\n", attempts)
+			}
+			if err == nil {
+				err = Err("%v failed", sub.Name)
+			}
+			return err
+		}
+		s.buildStatus = status
+		s.warn("Attempt %v of %v failed, retry in %v.", attempt, attempts, delay)
+		select {
+		case <-s.cancel:
+			return nil
+		case <-time.After(delay):
+		}
+		delay = time.Duration(float64(delay) * backoff)
+	}
+}
+
+func retryArgs(cmd *protocol.BuildCommand) (attempts int, delay time.Duration, backoff float64, err error) {
+	attempts, delay, backoff = 3, 10*time.Second, 2
+	if v, ok := cmd.Args["attempts"]; ok {
+		if attempts, err = strconv.Atoi(v); err != nil || attempts < 1 {
+			return 0, 0, 0, Err("Invalid retry attempts: %v", v)
+		}
+	}
+	if v, ok := cmd.Args["delay"]; ok {
+		if delay, err = time.ParseDuration(v); err != nil || delay < 0 {
+			return 0, 0, 0, Err("Invalid retry delay: %v", v)
+		}
+	}
+	if v, ok := cmd.Args["backoff"]; ok {
+		if backoff, err = strconv.ParseFloat(v, 64); err != nil || backoff < 1 {
+			return 0, 0, 0, Err("Invalid retry backoff: %v", v)
+		}
+	}
+	return attempts, delay, backoff, nil
+}
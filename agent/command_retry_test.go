@@ -0,0 +1,109 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+// passOnAttempt fails until it has been run n times, counting runs in
+// file name of the working directory.
+func passOnAttempt(name string, n int) *protocol.BuildCommand {
+	script := Sprintf(`n=$(cat %v 2>/dev/null || echo 0); n=$((n+1)); echo $n > %v; echo attempt $n; [ $n -ge %v ]`, name, name, n)
+	return protocol.ExecCommand("sh", "-c", script)
+}
+
+func TestRetryCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	delay := 10 * time.Millisecond
+	verify(t, []TestRow{
+		{protocol.RetryCommand(3, delay, 2, passOnAttempt("first", 1)),
+			"attempt 1\n", "Passed"},
+		{protocol.ComposeCommand(
+			protocol.RetryCommand(3, delay, 2, passOnAttempt("third", 3)),
+			echo("after retry")),
+			`attempt 1
+ERROR: exit status 1
+WARN: Attempt 1 of 3 failed, retry in 10ms.
+attempt 2
+ERROR: exit status 1
+WARN: Attempt 2 of 3 failed, retry in 20ms.
+attempt 3
+Attempt 3 of 3 passed.
+after retry
+`, "Passed"},
+		{protocol.ComposeCommand(
+			protocol.RetryCommand(2, delay, 1, passOnAttempt("never", 3)),
+			echo("skipped"),
+			echo("always").RunIf("any")),
+			`attempt 1
+ERROR: exit status 1
+WARN: Attempt 1 of 2 failed, retry in 10ms.
+attempt 2
+ERROR: exit status 1
+Gave up after 2 attempts.
+always
+`, "Failed"},
+		{protocol.RetryCommand(0, delay, 1, echo("never")),
+			"ERROR: Invalid retry attempts: 0\n", "Failed"},
+		{protocol.NewBuildCommand(protocol.CommandRetry),
+			"ERROR: retry needs exactly one sub command, got 0\n", "Failed"},
+	})
+}
+
+func TestRetryCommandInFailedBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	delay := 10 * time.Millisecond
+	verify(t, []TestRow{
+		{protocol.ComposeCommand(
+			protocol.FailCommand("broken"),
+			protocol.RetryCommand(3, delay, 1, passOnAttempt("failed-build-first", 1).RunIf("any")).RunIf("any")),
+			"ERROR: broken\nattempt 1\n", "Failed"},
+		{protocol.ComposeCommand(
+			protocol.FailCommand("broken"),
+			protocol.RetryCommand(3, delay, 1, passOnAttempt("failed-build-second", 2).RunIf("any")).RunIf("any")),
+			`ERROR: broken
+attempt 1
+WARN: Attempt 1 of 3 failed, retry in 10ms.
+attempt 2
+Attempt 2 of 3 passed.
+`, "Failed"},
+	})
+}
+
+func TestCancelBuildWhileRetryIsWaiting(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.RetryCommand(3, time.Minute, 1, protocol.FailCommand("flaky")),
+		echo("should not process this echo"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	time.Sleep(100 * time.Millisecond)
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: flaky\nWARN: Attempt 1 of 3 failed, retry in 1m0s.\n", trimTimestamp(log))
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"testing"
+	"time"
+)
+
+func sleep(seconds string) *protocol.BuildCommand {
+	return protocol.ExecCommand("sleep", seconds)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	timeout := 200 * time.Millisecond
+	verify(t, []TestRow{
+		{protocol.ComposeCommand(
+			echo("before"),
+			sleep("5").SetTimeout(timeout).SetOnCancel(echo("cleanup")),
+			echo("skipped"),
+			echo("always").RunIf("any")),
+			"before\ncleanup\nERROR: exec timed out after 200ms\nalways\n", "Failed"},
+		{echo("in time").SetTimeout(time.Minute),
+			"in time\n", "Passed"},
+		{echo("never").SetTimeout(-time.Second),
+			"ERROR: Invalid timeout of echo: -1s is not positive\n", "Failed"},
+	})
+}
+
+func TestCommandTimeoutCancelsComposeSubCommands(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	verify(t, []TestRow{
+		{protocol.ComposeCommand(
+			echo("compose"),
+			sleep("5").SetOnCancel(echo("sleep cleanup")),
+			echo("skipped"),
+		).SetTimeout(200 * time.Millisecond).SetOnCancel(echo("compose cleanup")),
+			"compose\nsleep cleanup\ncompose cleanup\nERROR: compose timed out after 200ms\n", "Failed"},
+		{protocol.ComposeCommand(
+			sleep("5").SetTimeout(100*time.Millisecond).SetOnCancel(echo("inner cleanup")),
+			echo("after inner").RunIf("any"),
+		).SetTimeout(time.Minute).SetOnCancel(echo("outer cleanup")),
+			"inner cleanup\nERROR: exec timed out after 100ms\nafter inner\n", "Failed"},
+		{protocol.ComposeCommand(
+			sleep("5").SetTimeout(time.Minute).SetOnCancel(echo("inner cleanup")),
+		).SetTimeout(200 * time.Millisecond),
+			"inner cleanup\nERROR: compose timed out after 200ms\n", "Failed"},
+	})
+}
+
+func TestCommandTimeoutInsideCond(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	verify(t, []TestRow{
+		{protocol.CondCommand(
+			protocol.ComposeCommand(),
+			sleep("5").SetTimeout(200*time.Millisecond).SetOnCancel(echo("branch cleanup")),
+			echo("else")),
+			"branch cleanup\nERROR: exec timed out after 200ms\n", "Failed"},
+		{protocol.CondCommand(
+			protocol.ComposeCommand(),
+			sleep("5").SetOnCancel(echo("branch cleanup")),
+		).SetTimeout(200 * time.Millisecond),
+			"branch cleanup\nERROR: cond timed out after 200ms\n", "Failed"},
+	})
+}
@@ -17,27 +17,63 @@
 package agent
 
 import (
+	"crypto/tls"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
-	"crypto/tls"
 )
 
+const (
+	defaultSendMessageTimeout    = 120 * time.Second
+	defaultServerSilenceTimeout  = 1 * time.Minute
+	defaultShutdownGracePeriod   = 5 * time.Minute
+	defaultReconnectBuildTimeout = 10 * time.Minute
+	defaultLogFile               = "gocd-golang-agent.log"
+	defaultWebSocketPath         = "/agent-websocket"
+	defaultRegistrationPath      = "/admin/agent"
+)
+
+var defaultReconnect = ReconnectPolicy{
+	BaseDelay:  10 * time.Second,
+	MaxDelay:   5 * time.Minute,
+	Jitter:     0.5,
+	ResetAfter: 1 * time.Minute,
+}
+
 type Config struct {
-	Hostname           string
-	SendMessageTimeout time.Duration
-	ServerUrl          *url.URL
-	ServerHostAndPort  string
-	ContextPath        string
-	WebSocketPath      string
-	RegistrationPath   string
-	WorkingDir         string
-	LogDir             string
-	ConfigDir          string
-	IpAddress          string
+	Hostname              string
+	SendMessageTimeout    time.Duration
+	ServerSilenceTimeout  time.Duration
+	ShutdownGracePeriod   time.Duration
+	Reconnect             ReconnectPolicy
+	ReconnectBuildTimeout time.Duration
+	Servers               *ServerList
+	ContextPath           string
+	WebSocketPath         string
+	WebsocketCodec        string
+	RegistrationPath      string
+	WorkingDir            string
+	LogDir                string
+	LogFile               string
+	LogLevel              LogLevel
+	LogFormat             string
+	LogMaxSize            int64
+	LogRotateInterval     time.Duration
+	LogMaxFiles           int
+	ConfigDir             string
+	ConfigFile            string
+	PluginsDir            string
+	IpAddress             string
+	AdminAddress          string
+	ProxyUrl              string
+	OneShot               bool
+	IdleTimeout           time.Duration
+	AgentCount            int
+	Proxy                 func(*url.URL) (*url.URL, error)
 
 	AgentAutoRegisterKey             string
 	AgentAutoRegisterResources       string
@@ -45,54 +81,243 @@ type Config struct {
 	AgentAutoRegisterElasticAgentId  string
 	AgentAutoRegisterElasticPluginId string
 
-	GoServerCAFile      string
 	AgentPrivateKeyFile string
 	AgentCertFile       string
 	AgentIdFile         string
+	BuildStateFile      string
 	OutputDebugLog      bool
 }
 
-func LoadConfig() *Config {
-	gocdServerURL := readEnv("GOCD_SERVER_URL", "https://localhost:8154/go")
-	os.Setenv("GO_SERVER_URL", gocdServerURL)
-	serverUrl, err := url.Parse(gocdServerURL)
-	if err != nil {
-		panic(err)
+// LoadConfig returns the first error found in environment variables
+// and config file, ValidateConfig lists all of them.
+func LoadConfig() (*Config, error) {
+	config, errs := loadConfig()
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
-	serverUrl.Scheme = "https"
-	hostname, _ := os.Hostname()
+	os.Setenv("GO_SERVER_URL", config.HttpsServerURL())
+	config.IpAddress = lookupIpAddress(config)
+	return config, nil
+}
+
+// ValidateConfig checks environment variables and config file
+// without connecting to Go server.
+func ValidateConfig() []error {
+	_, errs := loadConfig()
+	return errs
+}
+
+func loadConfig() (*Config, []error) {
+	var errs []error
 	wd, err := filepath.Abs(os.Getenv("GOCD_AGENT_WORKING_DIR"))
 	if err != nil {
-		panic(Sprintf("GOCD_AGENT_WORKING_DIR is invalid: %v", err))
+		errs = append(errs, Err("GOCD_AGENT_WORKING_DIR is invalid: %v", err))
 	}
 	wd = filepath.Clean(wd)
 	configDir := filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"))
-	return &Config{
-		Hostname:                         hostname,
-		SendMessageTimeout:               120 * time.Second,
-		ServerUrl:                        serverUrl,
-		ServerHostAndPort:                serverUrl.Host,
+	src := newConfigSource(filepath.Join(configDir, ConfigFileName))
+
+	var serverUrls []*url.URL
+	for _, gocdServerURL := range strings.Split(src.string("GOCD_SERVER_URL", "https://localhost:8154/go"), ",") {
+		serverUrl, err := url.Parse(strings.TrimSpace(gocdServerURL))
+		if err != nil {
+			src.invalid("GOCD_SERVER_URL", err)
+			continue
+		}
+		serverUrl.Scheme = "https"
+		serverUrls = append(serverUrls, serverUrl)
+	}
+	if len(serverUrls) == 0 {
+		serverUrls = append(serverUrls, &url.URL{Scheme: "https"})
+	}
+	hostname, _ := os.Hostname()
+	config := &Config{
+		Hostname:              src.string("GOCD_AGENT_HOSTNAME", hostname),
+		SendMessageTimeout:    src.duration("GOCD_AGENT_SEND_MESSAGE_TIMEOUT", defaultSendMessageTimeout),
+		ServerSilenceTimeout:  src.duration("GOCD_AGENT_SERVER_SILENCE_TIMEOUT", defaultServerSilenceTimeout),
+		ShutdownGracePeriod:   src.duration("GOCD_AGENT_SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod),
+		ReconnectBuildTimeout: src.duration("GOCD_AGENT_RECONNECT_BUILD_TIMEOUT", defaultReconnectBuildTimeout),
+		Reconnect: ReconnectPolicy{
+			BaseDelay:  src.duration("GOCD_AGENT_RECONNECT_BASE_DELAY", defaultReconnect.BaseDelay),
+			MaxDelay:   src.duration("GOCD_AGENT_RECONNECT_MAX_DELAY", defaultReconnect.MaxDelay),
+			Jitter:     src.float("GOCD_AGENT_RECONNECT_JITTER", defaultReconnect.Jitter),
+			ResetAfter: src.duration("GOCD_AGENT_RECONNECT_RESET_AFTER", defaultReconnect.ResetAfter),
+		},
+		Servers:                          NewServerList(serverUrls),
 		WorkingDir:                       wd,
-		LogDir:                           os.Getenv("GOCD_AGENT_LOG_DIR"),
+		LogDir:                           src.string("GOCD_AGENT_LOG_DIR", ""),
+		LogFile:                          defaultLogFile,
+		LogFormat:                        src.string("GOCD_AGENT_LOG_FORMAT", LogFormatText),
+		LogMaxSize:                       int64(src.int("GOCD_AGENT_LOG_MAX_SIZE_MB", 0)) * 1024 * 1024,
+		LogRotateInterval:                src.duration("GOCD_AGENT_LOG_ROTATE_INTERVAL", 0),
+		LogMaxFiles:                      src.int("GOCD_AGENT_LOG_MAX_FILES", 5),
+		AdminAddress:                     src.string("GOCD_AGENT_ADMIN_ADDRESS", ""),
+		ProxyUrl:                         src.string("GOCD_AGENT_PROXY_URL", ""),
+		OneShot:                          src.bool("GOCD_AGENT_ONE_SHOT"),
+		IdleTimeout:                      src.duration("GOCD_AGENT_IDLE_TIMEOUT", 0),
+		AgentCount:                       src.int("GOCD_AGENT_COUNT", 1),
 		ConfigDir:                        configDir,
-		GoServerCAFile:                   filepath.Join(configDir, "go-server-ca.pem"),
-		AgentPrivateKeyFile:              filepath.Join(configDir, "agent-private-key.pem"),
-		AgentCertFile:                    filepath.Join(configDir, "agent-cert.pem"),
-		AgentIdFile:                      filepath.Join(configDir, "agent-id"),
-		AgentAutoRegisterKey:             os.Getenv("GOCD_AGENT_AUTO_REGISTER_KEY"),
-		AgentAutoRegisterResources:       os.Getenv("GOCD_AGENT_AUTO_REGISTER_RESOURCES"),
-		AgentAutoRegisterEnvironments:    os.Getenv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS"),
-		AgentAutoRegisterElasticAgentId:  os.Getenv("GOCD_AGENT_AUTO_REGISTER_ELASTIC_AGENT_ID"),
-		AgentAutoRegisterElasticPluginId: os.Getenv("GOCD_AGENT_AUTO_REGISTER_ELASTIC_PLUGIN_ID"),
-		OutputDebugLog:                   os.Getenv("DEBUG") != "",
-		WebSocketPath:                    readEnv("GOCD_SERVER_WEB_SOCKET_PATH", "/agent-websocket"),
-		RegistrationPath:                 readEnv("GOCD_SERVER_REGISTRATION_PATH", "/admin/agent"),
-		IpAddress:                        lookupIpAddress(serverUrl.Host),
-	}
-}
-
-func lookupIpAddress(host string) string {
-	conn, err := tls.Dial("tcp", host, &tls.Config{
+		ConfigFile:                       src.path,
+		PluginsDir:                       absPath(wd, src.string("GOCD_AGENT_PLUGINS_DIR", "plugins")),
+		AgentAutoRegisterKey:             src.string("GOCD_AGENT_AUTO_REGISTER_KEY", ""),
+		AgentAutoRegisterResources:       src.string("GOCD_AGENT_AUTO_REGISTER_RESOURCES", ""),
+		AgentAutoRegisterEnvironments:    src.string("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS", ""),
+		AgentAutoRegisterElasticAgentId:  src.string("GOCD_AGENT_AUTO_REGISTER_ELASTIC_AGENT_ID", ""),
+		AgentAutoRegisterElasticPluginId: src.string("GOCD_AGENT_AUTO_REGISTER_ELASTIC_PLUGIN_ID", ""),
+		OutputDebugLog:                   os.Getenv("DEBUG") != "" || src.bool("DEBUG"),
+		WebSocketPath:                    src.string("GOCD_SERVER_WEB_SOCKET_PATH", defaultWebSocketPath),
+		WebsocketCodec:                   src.string("GOCD_AGENT_WEBSOCKET_CODEC", protocol.GzipCodec),
+		RegistrationPath:                 src.string("GOCD_SERVER_REGISTRATION_PATH", defaultRegistrationPath),
+	}
+	config.setConfigFiles()
+	if jitter := config.Reconnect.Jitter; jitter < 0 || jitter > 1 {
+		src.invalid("GOCD_AGENT_RECONNECT_JITTER", Err("%v is not between 0 and 1", jitter))
+	}
+	if config.ProxyUrl != "" {
+		if u, err := url.Parse(config.ProxyUrl); err != nil {
+			src.invalid("GOCD_AGENT_PROXY_URL", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			src.invalid("GOCD_AGENT_PROXY_URL", Err("%v is not a http or https url", config.ProxyUrl))
+		}
+	}
+	if config.AgentCount < 1 {
+		src.invalid("GOCD_AGENT_COUNT", Err("%v is less than 1", config.AgentCount))
+	}
+	if !protocol.IsWebsocketCodec(config.WebsocketCodec) {
+		src.invalid("GOCD_AGENT_WEBSOCKET_CODEC", Err("%v is not one of %v", config.WebsocketCodec, strings.Join(protocol.WebsocketCodecs, ", ")))
+	}
+	if config.ServerSilenceTimeout == 0 {
+		// 0 disables the watch, applyDefaults only fills in a zero left
+		// by a Config made by hand
+		config.ServerSilenceTimeout = -1
+	}
+	config.Proxy = NewProxyFunc(config.ProxyUrl)
+	if config.IsElasticAgent() {
+		config.OneShot = true
+	}
+	if config.OutputDebugLog {
+		config.LogLevel = LevelDebug
+	} else if level, err := ParseLogLevel(src.string("GOCD_AGENT_LOG_LEVEL", "info")); err != nil {
+		src.invalid("GOCD_AGENT_LOG_LEVEL", err)
+	} else {
+		config.LogLevel = level
+	}
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		src.invalid("GOCD_AGENT_LOG_FORMAT", Err("%v is neither %v nor %v", config.LogFormat, LogFormatText, LogFormatJSON))
+	}
+	return config, append(errs, src.errors...)
+}
+
+// AgentConfigs splits config into one config per agent when
+// AgentCount is greater than 1. Agent i works in sub directory
+// agent-i of WorkingDir and keeps its own certificates, agent id and
+// log file.
+func (c *Config) AgentConfigs() []*Config {
+	if c.AgentCount <= 1 {
+		return []*Config{c}
+	}
+	configs := make([]*Config, c.AgentCount)
+	for i := range configs {
+		name := Sprintf("agent-%v", i+1)
+		ac := *c
+		ac.AgentCount = 1
+		ac.WorkingDir = filepath.Join(c.WorkingDir, name)
+		ac.ConfigDir = filepath.Join(c.ConfigDir, name)
+		ac.LogFile = Sprintf("gocd-golang-agent-%v.log", i+1)
+		ac.Servers = NewServerList(c.Servers.All())
+		ac.setConfigFiles()
+		configs[i] = &ac
+	}
+	return configs
+}
+
+func (c *Config) setConfigFiles() {
+	c.AgentPrivateKeyFile = filepath.Join(c.ConfigDir, "agent-private-key.pem")
+	c.AgentCertFile = filepath.Join(c.ConfigDir, "agent-cert.pem")
+	c.AgentIdFile = filepath.Join(c.ConfigDir, "agent-id")
+	c.BuildStateFile = filepath.Join(c.ConfigDir, "build-state.json")
+}
+
+// applyDefaults fills settings left empty in a Config that was not
+// made by LoadConfig. Zero durations that turn a feature off, like
+// IdleTimeout, are kept.
+func (c *Config) applyDefaults() error {
+	if c.Servers == nil || c.Servers.Len() == 0 {
+		return Err("config has no Go server url")
+	}
+	if c.WorkingDir == "" {
+		return Err("config has no working directory")
+	}
+	wd, err := filepath.Abs(c.WorkingDir)
+	if err != nil {
+		return Err("working directory %v is invalid: %v", c.WorkingDir, err)
+	}
+	c.WorkingDir = wd
+	if c.Hostname == "" {
+		c.Hostname, _ = os.Hostname()
+	}
+	if c.SendMessageTimeout == 0 {
+		c.SendMessageTimeout = defaultSendMessageTimeout
+	}
+	if c.ServerSilenceTimeout == 0 {
+		c.ServerSilenceTimeout = defaultServerSilenceTimeout
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	if c.ReconnectBuildTimeout == 0 {
+		c.ReconnectBuildTimeout = defaultReconnectBuildTimeout
+	}
+	if c.Reconnect == (ReconnectPolicy{}) {
+		c.Reconnect = defaultReconnect
+	}
+	if c.WebSocketPath == "" {
+		c.WebSocketPath = defaultWebSocketPath
+	}
+	if c.WebsocketCodec == "" {
+		c.WebsocketCodec = protocol.GzipCodec
+	}
+	if c.RegistrationPath == "" {
+		c.RegistrationPath = defaultRegistrationPath
+	}
+	if c.LogFile == "" {
+		c.LogFile = defaultLogFile
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = LogFormatText
+	}
+	if c.ConfigDir == "" {
+		c.ConfigDir = filepath.Join(c.WorkingDir, "config")
+	}
+	if c.ConfigFile == "" {
+		c.ConfigFile = filepath.Join(c.ConfigDir, ConfigFileName)
+	}
+	if c.PluginsDir == "" {
+		c.PluginsDir = filepath.Join(c.WorkingDir, "plugins")
+	}
+	if c.AgentPrivateKeyFile == "" {
+		c.AgentPrivateKeyFile = filepath.Join(c.ConfigDir, "agent-private-key.pem")
+	}
+	if c.AgentCertFile == "" {
+		c.AgentCertFile = filepath.Join(c.ConfigDir, "agent-cert.pem")
+	}
+	if c.AgentIdFile == "" {
+		c.AgentIdFile = filepath.Join(c.ConfigDir, "agent-id")
+	}
+	if c.BuildStateFile == "" {
+		c.BuildStateFile = filepath.Join(c.ConfigDir, "build-state.json")
+	}
+	if c.AgentCount == 0 {
+		c.AgentCount = 1
+	}
+	if c.Proxy == nil {
+		c.Proxy = NewProxyFunc(c.ProxyUrl)
+	}
+	return nil
+}
+
+func lookupIpAddress(c *Config) string {
+	conn, err := c.dialGoServer(c.ServerUrl(), &tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
@@ -119,8 +344,30 @@ func checkAllInterfaces() string {
 	return "127.0.0.1"
 }
 
+func (c *Config) ServerUrl() *url.URL {
+	return c.Servers.Current()
+}
+
+func (c *Config) ServerHostAndPort() string {
+	return c.ServerUrl().Host
+}
+
+func (c *Config) GoServerCAFile() string {
+	return c.ServerCAFile(c.ServerUrl())
+}
+
+// ServerCAFile keeps CA certificate of each Go server in its own file
+// when agent is configured with more than one server.
+func (c *Config) ServerCAFile(server *url.URL) string {
+	if c.Servers.Len() == 1 {
+		return filepath.Join(c.ConfigDir, "go-server-ca.pem")
+	}
+	name := strings.Replace(server.Host, ":", "_", -1)
+	return filepath.Join(c.ConfigDir, Sprintf("go-server-ca-%v.pem", name))
+}
+
 func (c *Config) HttpsServerURL() string {
-	return c.ServerUrl.String()
+	return c.ServerUrl().String()
 }
 
 func (c *Config) WssServerURL() string {
@@ -142,7 +389,14 @@ func (c *Config) MakeFullServerURL(u string) (*url.URL, error) {
 }
 
 func (c *Config) IsElasticAgent() bool {
-	return config.AgentAutoRegisterElasticPluginId == ""
+	return c.AgentAutoRegisterElasticPluginId != ""
+}
+
+func absPath(wd, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(wd, path)
 }
 
 func readEnv(varname string, defaultVal string) string {
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ConfigFileName = "agent-config.yaml"
+
+// Settings can be given by environment variables or in the config file.
+// The config file key of a setting is its environment variable name in
+// lower case without "GOCD_" prefix, e.g. "agent_log_dir" for
+// GOCD_AGENT_LOG_DIR. Environment variables take precedence.
+var configFileSettings = []string{
+	"GOCD_SERVER_URL",
+	"GOCD_SERVER_WEB_SOCKET_PATH",
+	"GOCD_SERVER_REGISTRATION_PATH",
+	"GOCD_AGENT_HOSTNAME",
+	"GOCD_AGENT_LOG_DIR",
+	"GOCD_AGENT_LOG_LEVEL",
+	"GOCD_AGENT_LOG_FORMAT",
+	"GOCD_AGENT_LOG_MAX_SIZE_MB",
+	"GOCD_AGENT_LOG_ROTATE_INTERVAL",
+	"GOCD_AGENT_LOG_MAX_FILES",
+	"GOCD_AGENT_ADMIN_ADDRESS",
+	"GOCD_AGENT_PROXY_URL",
+	"GOCD_AGENT_ONE_SHOT",
+	"GOCD_AGENT_IDLE_TIMEOUT",
+	"GOCD_AGENT_COUNT",
+	"GOCD_AGENT_WEBSOCKET_CODEC",
+	"GOCD_AGENT_PLUGINS_DIR",
+	"GOCD_AGENT_AUTO_REGISTER_KEY",
+	"GOCD_AGENT_AUTO_REGISTER_RESOURCES",
+	"GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS",
+	"GOCD_AGENT_AUTO_REGISTER_ELASTIC_AGENT_ID",
+	"GOCD_AGENT_AUTO_REGISTER_ELASTIC_PLUGIN_ID",
+	"GOCD_AGENT_SEND_MESSAGE_TIMEOUT",
+	"GOCD_AGENT_SERVER_SILENCE_TIMEOUT",
+	"GOCD_AGENT_SHUTDOWN_GRACE_PERIOD",
+	"GOCD_AGENT_RECONNECT_BUILD_TIMEOUT",
+	"GOCD_AGENT_RECONNECT_BASE_DELAY",
+	"GOCD_AGENT_RECONNECT_MAX_DELAY",
+	"GOCD_AGENT_RECONNECT_JITTER",
+	"GOCD_AGENT_RECONNECT_RESET_AFTER",
+	"DEBUG",
+}
+
+func configFileKey(env string) string {
+	return strings.ToLower(strings.TrimPrefix(env, "GOCD_"))
+}
+
+type configSource struct {
+	path   string
+	file   map[string]string
+	errors []error
+}
+
+func newConfigSource(path string) *configSource {
+	src := &configSource{path: path, file: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return src
+	}
+	if err != nil {
+		src.errors = append(src.errors, err)
+		return src
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		src.errors = append(src.errors, Err("%v is invalid: %v", path, err))
+		return src
+	}
+	known := make(map[string]string)
+	for _, env := range configFileSettings {
+		known[configFileKey(env)] = env
+	}
+	for key, value := range values {
+		env, ok := known[key]
+		if !ok {
+			src.errors = append(src.errors, Err("unknown key %v in %v", key, path))
+			continue
+		}
+		switch value.(type) {
+		case nil:
+			src.file[env] = ""
+		case map[interface{}]interface{}, []interface{}:
+			src.errors = append(src.errors, Err("%v in %v is invalid: expected a single value", key, path))
+		default:
+			src.file[env] = Sprintf("%v", value)
+		}
+	}
+	return src
+}
+
+func (src *configSource) lookup(env string) (string, string) {
+	if val := os.Getenv(env); val != "" {
+		return val, env
+	}
+	return src.file[env], Sprintf("%v in %v", configFileKey(env), src.path)
+}
+
+func (src *configSource) invalid(name string, err error) {
+	src.errors = append(src.errors, Err("%v is invalid: %v", name, err))
+}
+
+func (src *configSource) string(env, defaultVal string) string {
+	val, _ := src.lookup(env)
+	if val == "" {
+		return defaultVal
+	}
+	return val
+}
+
+func (src *configSource) duration(env string, defaultVal time.Duration) time.Duration {
+	val, name := src.lookup(env)
+	if val == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		src.invalid(name, err)
+		return defaultVal
+	}
+	return d
+}
+
+func (src *configSource) float(env string, defaultVal float64) float64 {
+	val, name := src.lookup(env)
+	if val == "" {
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		src.invalid(name, err)
+		return defaultVal
+	}
+	return f
+}
+
+func (src *configSource) int(env string, defaultVal int) int {
+	val, name := src.lookup(env)
+	if val == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		src.invalid(name, err)
+		return defaultVal
+	}
+	return i
+}
+
+func (src *configSource) bool(env string) bool {
+	val, name := src.lookup(env)
+	if val == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		src.invalid(name, err)
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidateConfigReportsUnknownKeysAndBadValues(t *testing.T) {
+	defer writeConfigFile(t, `
+agent_auto_register_resources: linux
+agent_shutdown_grace_period: forever
+agent_reconnect_jitter: 2
+agent_websocket_codec: brotli
+server_name: gocd
+`)()
+	errs := ValidateConfig()
+	assert.Equal(t, 4, len(errs))
+	messages := Sprintf("%v", errs)
+	assert.True(t, contains(messages, "agent_shutdown_grace_period in "))
+	assert.True(t, contains(messages, "GOCD_AGENT_RECONNECT_JITTER is invalid: 2 is not between 0 and 1"))
+	assert.True(t, contains(messages, "GOCD_AGENT_WEBSOCKET_CODEC is invalid: brotli is not one of gzip, json, raw-deflate"))
+	assert.True(t, contains(messages, "unknown key server_name in "))
+}
+
+func TestValidateConfigPassesWhenThereIsNoConfigFile(t *testing.T) {
+	assert.Equal(t, 0, len(ValidateConfig()))
+}
+
+func TestEnvironmentVariablesTakePrecedenceOverConfigFile(t *testing.T) {
+	os.Setenv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS", "from-env")
+	defer os.Setenv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS", "")
+	defer writeConfigFile(t, `
+agent_auto_register_environments: from-file
+agent_auto_register_resources: from-file
+`)()
+	original := *testAgent.Config()
+	defer func() { *testAgent.Config() = original }()
+
+	assert.Nil(t, testAgent.ReloadConfig())
+	assert.Equal(t, "from-env", testAgent.Config().AgentAutoRegisterEnvironments)
+	assert.Equal(t, "from-file", testAgent.Config().AgentAutoRegisterResources)
+}
+
+func TestReloadConfigOnlyChangesReloadableSettings(t *testing.T) {
+	defer writeConfigFile(t, `
+agent_send_message_timeout: 5s
+server_web_socket_path: /somewhere-else
+`)()
+	original := *testAgent.Config()
+	defer func() { *testAgent.Config() = original }()
+
+	assert.Nil(t, testAgent.ReloadConfig())
+	assert.Equal(t, 5*time.Second, testAgent.Config().SendMessageTimeout)
+	assert.Equal(t, original.WebSocketPath, testAgent.Config().WebSocketPath)
+}
+
+func TestReloadConfigKeepsCurrentConfigWhenFileIsInvalid(t *testing.T) {
+	defer writeConfigFile(t, "agent_send_message_timeout: soon\n")()
+	original := testAgent.Config()
+
+	assert.NotNil(t, testAgent.ReloadConfig())
+	assert.Equal(t, original, testAgent.Config())
+}
+
+func TestBoolSettingIsParsedFromEnvironmentVariable(t *testing.T) {
+	os.Setenv("GOCD_AGENT_ONE_SHOT", "false")
+	defer os.Setenv("GOCD_AGENT_ONE_SHOT", "")
+	config, err := LoadConfig()
+	assert.Nil(t, err)
+	assert.False(t, config.OneShot)
+
+	os.Setenv("GOCD_AGENT_ONE_SHOT", "sometimes")
+	_, err = LoadConfig()
+	assert.NotNil(t, err)
+	assert.True(t, contains(err.Error(), "GOCD_AGENT_ONE_SHOT is invalid"), err)
+}
+
+func TestZeroServerSilenceTimeoutDisablesWatch(t *testing.T) {
+	os.Setenv("GOCD_AGENT_SERVER_SILENCE_TIMEOUT", "0")
+	defer os.Unsetenv("GOCD_AGENT_SERVER_SILENCE_TIMEOUT")
+	config, err := LoadConfig()
+	assert.Nil(t, err)
+	assert.True(t, config.ServerSilenceTimeout < 0)
+}
+
+func TestReloadConfigWhileBuildIsRunning(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	removeConfigFile := writeConfigFile(t, "agent_send_message_timeout: 5s\n")
+	defer testAgent.ReloadConfig()
+	defer removeConfigFile()
+
+	goServer.SendBuild(testAgent.Id(), buildId, protocol.ExecCommand("sleep", "0.2"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Nil(t, testAgent.ReloadConfig())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Equal(t, 5*time.Second, testAgent.Config().SendMessageTimeout)
+}
+
+func writeConfigFile(t *testing.T, content string) func() {
+	path := testAgent.Config().ConfigFile
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err)
+	return func() {
+		os.Remove(path)
+	}
+}
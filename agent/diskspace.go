@@ -21,17 +21,17 @@ import (
 	"syscall"
 )
 
-func UsableSpace() int64 {
+func UsableSpace(logger *Logger) int64 {
 	_, free, err := diskSpace("/")
 	if err != nil {
-		LogInfo("Unknown diskspace, error: %v", err)
+		logger.Info.Printf("Unknown diskspace, error: %v", err)
 		return -1
 	}
 	return free
 }
 
-func UsableSpaceString() string {
-	return strconv.FormatInt(UsableSpace(), 10)
+func UsableSpaceString(logger *Logger) string {
+	return strconv.FormatInt(UsableSpace(logger), 10)
 }
 
 // Space returns total and free bytes available in a directory, e.g. `/`.
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisteredExecutorRunsCustomBuildCommand(t *testing.T) {
+	agents := newTestAgents(t, 1)
+	defer removeTestAgents(agents)
+	a := agents[0]
+	a.RegisterExecutor("greet", func(s *BuildSession, cmd *protocol.BuildCommand) error {
+		_, err := fmt.Fprintf(s.Output(), "hello %v\n", cmd.Args["name"])
+		return err
+	})
+	assert.False(t, contains(strings.Join(testAgent.SupportedCommands(), ","), "greet"))
+
+	buildId = callerName(1)
+	stateLog.Reset(buildId, a.Id())
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Start()
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	goServer.SendBuild(a.Id(), buildId, protocol.NewBuildCommand("greet").AddArg("name", "gocd"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	goServer.Send(a.Id(), protocol.ReregisterMessage())
+	<-stopped
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello gocd\n", trimTimestamp(log))
+}
+
+func TestNewAgentAppliesDefaultsToConfigMadeByHand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embed")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewAgent(&Config{WorkingDir: dir})
+	assert.NotNil(t, err)
+
+	server, _ := url.Parse(goServerUrl)
+	a, err := NewAgent(&Config{
+		WorkingDir:       dir,
+		Servers:          NewServerList([]*url.URL{server}),
+		RegistrationPath: testAgent.Config().RegistrationPath,
+	})
+	assert.Nil(t, err)
+	config := a.Config()
+	assert.NotNil(t, config.Proxy)
+	assert.Equal(t, filepath.Join(dir, "config", "agent-id"), config.AgentIdFile)
+	assert.Equal(t, "/agent-websocket", config.WebSocketPath)
+	assert.Equal(t, 5*time.Minute, config.ShutdownGracePeriod)
+	assert.Equal(t, 1*time.Minute, config.ServerSilenceTimeout)
+	assert.Equal(t, 10*time.Second, config.Reconnect.BaseDelay)
+	assert.Nil(t, a.Register())
+}
+
+func TestSetLoggerClosesLogFileAgentOpened(t *testing.T) {
+	agents := newTestAgents(t, 1)
+	defer removeTestAgents(agents)
+	a := agents[0]
+	created := a.Logger()
+	assert.Nil(t, created.Info.Output(1, "before SetLogger"))
+
+	a.SetLogger(NewLogger(LogOptions{Output: ioutil.Discard, Level: LevelInfo}))
+	assert.NotNil(t, created.Info.Output(1, "after SetLogger"))
+}
+
+func TestRunStopsWhenContextIsDone(t *testing.T) {
+	agents := newTestAgents(t, 1)
+	defer removeTestAgents(agents)
+	a := agents[0]
+	var logs bytes.Buffer
+	a.SetLogger(NewLogger(LogOptions{Output: &logs, Level: LevelInfo, Format: LogFormatText}))
+
+	stateLog.Reset("", a.Id())
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Run(ctx)
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop after context is canceled")
+	}
+	assert.True(t, contains(logs.String(), "INFO  agent stopped agentId="+a.Id()), logs.String())
+}
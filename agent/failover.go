@@ -0,0 +1,163 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type ServerList struct {
+	mu      sync.Mutex
+	urls    []*url.URL
+	current int
+}
+
+func NewServerList(urls []*url.URL) *ServerList {
+	return &ServerList{urls: urls}
+}
+
+func (l *ServerList) Len() int {
+	return len(l.urls)
+}
+
+func (l *ServerList) Current() *url.URL {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.urls[l.current]
+}
+
+func (l *ServerList) All() []*url.URL {
+	return l.urls
+}
+
+// FailoverFrom switches to the next server unless someone else already
+// failed over from the given server.
+func (l *ServerList) FailoverFrom(server *url.URL) *url.URL {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.urls[l.current] == server && len(l.urls) > 1 {
+		l.current = (l.current + 1) % len(l.urls)
+	}
+	return l.urls[l.current]
+}
+
+func (l *ServerList) Find(u *url.URL) *url.URL {
+	for _, server := range l.urls {
+		if u.Host != server.Host {
+			continue
+		}
+		prefix := strings.TrimSuffix(server.Path, "/")
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return server
+		}
+	}
+	return nil
+}
+
+type failoverTransport struct {
+	agent          *Agent
+	servers        *ServerList
+	withClientCert bool
+
+	mu         sync.Mutex
+	transports map[*url.URL]*http.Transport
+}
+
+func newFailoverTransport(agent *Agent, withClientCert bool) *failoverTransport {
+	return &failoverTransport{
+		agent:          agent,
+		servers:        agent.Config().Servers,
+		withClientCert: withClientCert,
+		transports:     make(map[*url.URL]*http.Transport),
+	}
+}
+
+func (t *failoverTransport) transport(server *url.URL) (*http.Transport, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr, ok := t.transports[server]; ok {
+		return tr, nil
+	}
+	if err := t.agent.readGoServerCACert(server); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := t.agent.goServerTlsConfig(server, t.withClientCert)
+	if err != nil {
+		return nil, err
+	}
+	proxy := t.agent.Config().Proxy
+	tr := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		},
+	}
+	t.transports[server] = tr
+	return tr, nil
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	from := t.servers.Find(req.URL)
+	if from == nil {
+		tr, err := t.transport(t.servers.Current())
+		if err != nil {
+			return nil, err
+		}
+		return tr.RoundTrip(req)
+	}
+	replayable := req.Body == nil || req.GetBody != nil
+	var err error
+	for i := 0; i < t.servers.Len(); i++ {
+		server := t.servers.Current()
+		var resp *http.Response
+		if resp, err = t.roundTrip(req, from, server, i > 0); err == nil {
+			return resp, nil
+		}
+		if !replayable {
+			return nil, err
+		}
+		t.agent.failoverFrom(server)
+	}
+	return nil, err
+}
+
+func (t *failoverTransport) roundTrip(req *http.Request, from, server *url.URL, retry bool) (*http.Response, error) {
+	tr, err := t.transport(server)
+	if err != nil {
+		return nil, err
+	}
+	if from == server && !retry {
+		return tr.RoundTrip(req)
+	}
+	u, err := url.Parse(server.String() + strings.TrimPrefix(req.URL.String(), from.String()))
+	if err != nil {
+		return nil, err
+	}
+	r := new(http.Request)
+	*r = *req
+	r.URL = u
+	r.Host = ""
+	if req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return tr.RoundTrip(r)
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"net/url"
+	"testing"
+)
+
+func TestFailoverToNextServerWhenCurrentIsUnreachable(t *testing.T) {
+	servers := testAgent.Config().Servers
+	defer func() {
+		testAgent.Config().Servers = servers
+	}()
+	unreachable, _ := url.Parse("https://localhost:1")
+	testAgent.Config().Servers = NewServerList([]*url.URL{unreachable, servers.Current()})
+
+	setUp(t)
+	defer tearDown()
+	assert.Equal(t, servers.Current(), testAgent.Config().ServerUrl())
+
+	goServer.SendBuild(testAgent.Id(), buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+}
+
+func TestFailoverOnlyOnceFromSameServer(t *testing.T) {
+	a, _ := url.Parse("https://a:8154/go")
+	b, _ := url.Parse("https://b:8154/go")
+	servers := NewServerList([]*url.URL{a, b})
+
+	assert.Equal(t, b, servers.FailoverFrom(a))
+	assert.Equal(t, b, servers.FailoverFrom(a))
+	assert.Equal(t, a, servers.FailoverFrom(b))
+	assert.Equal(t, b, servers.Find(&url.URL{Scheme: "https", Host: "b:8154", Path: "/go/remoting"}))
+	assert.Nil(t, servers.Find(&url.URL{Scheme: "https", Host: "c:8154", Path: "/go"}))
+}
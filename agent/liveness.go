@@ -0,0 +1,83 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"golang.org/x/net/websocket"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// activityConn remembers when agent last read anything from Go
+// server: messages, acks and pong frames alike.
+type activityConn struct {
+	net.Conn
+	lastRead int64
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	return &activityConn{Conn: conn, lastRead: time.Now().UnixNano()}
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Silence returns how long nothing has been read from the connection.
+func (c *activityConn) Silence() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
+var pingFrame = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+// watchServerSilence sends websocket ping frames, so that Go server
+// has something to answer while agent is idle, and closes the
+// connection once Go server has been silent for timeout. A half-open
+// connection would otherwise keep agent waiting forever.
+func (a *Agent) watchServerSilence(ws *websocket.Conn, activity *activityConn, timeout time.Duration, closed chan bool) {
+	if timeout <= 0 {
+		return
+	}
+	tick := time.NewTicker(timeout / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-tick.C:
+			silence := activity.Silence()
+			if silence >= timeout {
+				a.logger.Error.Printf("Go server has been silent for %v, close websocket connection and reconnect", silence.Round(time.Millisecond))
+				serverSilenceTimeouts.Inc(a.id)
+				activity.Close()
+				return
+			}
+			if err := pingFrame.Send(ws, nil); err != nil {
+				a.logger.Debug.Printf("send websocket ping failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+func TestIdleConnectionStaysOpenWhileServerAnswersPings(t *testing.T) {
+	testAgent.Config().ServerSilenceTimeout = 300 * time.Millisecond
+	defer func() {
+		testAgent.Config().ServerSilenceTimeout = 1 * time.Minute
+	}()
+	setUp(t)
+	defer tearDown()
+
+	time.Sleep(1 * time.Second)
+	goServer.SendBuild(testAgent.Id(), buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestReconnectWhenServerGoesSilent(t *testing.T) {
+	testAgent.Config().ServerSilenceTimeout = 300 * time.Millisecond
+	defer func() {
+		testAgent.Config().ServerSilenceTimeout = 1 * time.Minute
+	}()
+	reconnect := setUpReconnectingAgent(t)
+	defer tearDown()
+
+	goServer.Silence(testAgent.Id(), 2*time.Second)
+	goServer.SendBuild(testAgent.Id(), buildId, echo("hello"))
+	select {
+	case reconnect <- true:
+	case <-time.After(1 * time.Second):
+		t.Fatal("agent did not close the silent connection")
+	}
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
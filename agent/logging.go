@@ -17,41 +17,192 @@
 package agent
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.ToLower(name) == n {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, Err("unknown log level %v, expect one of %v", name, strings.Join(logLevelNames, ", "))
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+type LogOptions struct {
+	// Output receives log entries when set, otherwise they go to File
+	// in Dir, or stdout when Dir is empty.
+	Output io.Writer
+
+	Dir    string
+	File   string
+	Level  LogLevel
+	Format string
+
+	// Rotation of the log file, no rotation when both MaxSize and
+	// RotateInterval are zero.
+	MaxSize        int64
+	RotateInterval time.Duration
+	MaxFiles       int
+}
+
+// Logger writes entries with the fields it was derived with by With.
+// Loggers derived from the same one share output and level.
 type Logger struct {
-	Info  *log.Logger
 	Debug *log.Logger
+	Info  *log.Logger
+	Warn  *log.Logger
 	Error *log.Logger
+
+	sink   *logSink
+	fields map[string]string
+}
+
+type logSink struct {
+	mu     sync.Mutex
+	output io.Writer
+	closer io.Closer
+	format string
+	level  LogLevel
 }
 
 func MakeLogger(logDir, file string, debug bool) *Logger {
-	var output, debugOutput io.Writer
-	if logDir != "" {
-		fpath := filepath.Join(logDir, file)
-		var err error
-		output, err = os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	level := LevelInfo
+	if debug {
+		level = LevelDebug
+	}
+	return NewLogger(LogOptions{Dir: logDir, File: file, Level: level, Format: LogFormatText})
+}
+
+func NewLogger(opts LogOptions) *Logger {
+	sink := &logSink{
+		output: opts.Output,
+		format: opts.Format,
+		level:  opts.Level,
+	}
+	switch {
+	case sink.output != nil:
+	case opts.Dir != "":
+		fpath := filepath.Join(opts.Dir, opts.File)
+		file, err := openRotatingFile(fpath, opts.MaxSize, opts.RotateInterval, opts.MaxFiles)
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		output = os.Stdout
+		sink.output = file
+		sink.closer = file
+	default:
+		sink.output = os.Stdout
 	}
+	return newLogger(sink, make(map[string]string))
+}
 
-	if debug {
-		debugOutput = output
+func newLogger(sink *logSink, fields map[string]string) *Logger {
+	l := &Logger{sink: sink, fields: fields}
+	l.Debug = log.New(&levelWriter{l, LevelDebug}, "", 0)
+	l.Info = log.New(&levelWriter{l, LevelInfo}, "", 0)
+	l.Warn = log.New(&levelWriter{l, LevelWarn}, "", 0)
+	l.Error = log.New(&levelWriter{l, LevelError}, "", log.Lshortfile)
+	return l
+}
+
+// Close closes the log file NewLogger opened, it does nothing when
+// the logger writes to LogOptions.Output or stdout.
+func (l *Logger) Close() error {
+	if l.sink.closer == nil {
+		return nil
+	}
+	return l.sink.closer.Close()
+}
+
+// SetLevel changes level of l and of all loggers derived from the
+// same logger.
+func (l *Logger) SetLevel(level LogLevel) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.level = level
+}
+
+// With returns a copy of l that adds the field to its entries, l is
+// not changed.
+func (l *Logger) With(key, value string) *Logger {
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return newLogger(l.sink, fields)
+}
+
+func (l *Logger) write(level LogLevel, msg string) error {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	if level < l.sink.level {
+		return nil
+	}
+	now := time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	var buf bytes.Buffer
+	if l.sink.format == LogFormatJSON {
+		entry := map[string]string{"time": now, "level": level.String(), "msg": msg}
+		for k, v := range l.fields {
+			entry[k] = v
+		}
+		if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+			return err
+		}
 	} else {
-		debugOutput = ioutil.Discard
+		buf.WriteString(Sprintf("%v %-5v %v", now, strings.ToUpper(level.String()), msg))
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteString(Sprintf(" %v=%v", k, l.fields[k]))
+		}
+		buf.WriteString("\n")
 	}
+	_, err := l.sink.output.Write(buf.Bytes())
+	return err
+}
 
-	debugLogger := log.New(debugOutput, "", 0)
-	infoLogger := log.New(output, "", 0)
-	errorLogger := log.New(output, "ERROR: ", log.Lshortfile)
+type levelWriter struct {
+	logger *Logger
+	level  LogLevel
+}
 
-	return &Logger{Debug: debugLogger, Info: infoLogger, Error: errorLogger}
+func (w *levelWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	if err := w.logger.write(w.level, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogWithFieldsAndLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l := NewLogger(LogOptions{Dir: dir, File: "agent.log", Level: LevelInfo, Format: LogFormatJSON}).With("agentId", "uuid")
+	l.Debug.Printf("hidden")
+	l.With("buildId", "build1").Warn.Printf("hello %v", "world")
+	l.Info.Printf("bye")
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "agent.log"))
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var entry map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "warn", entry["level"])
+	assert.Equal(t, "hello world", entry["msg"])
+	assert.Equal(t, "uuid", entry["agentId"])
+	assert.Equal(t, "build1", entry["buildId"])
+	assert.NotEqual(t, "", entry["time"])
+
+	entry = nil
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "", entry["buildId"])
+}
+
+func TestDerivedLoggersShareLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(LogOptions{Output: &buf, Level: LevelInfo, Format: LogFormatText})
+	build := l.With("buildId", "build1")
+	l.SetLevel(LevelWarn)
+	build.Info.Printf("hidden")
+	build.Warn.Printf("shown")
+	assert.True(t, strings.HasSuffix(buf.String(), "WARN  shown buildId=build1\n"), buf.String())
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestRotateLogFileBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l := NewLogger(LogOptions{Dir: dir, File: "agent.log", Level: LevelInfo, Format: LogFormatText, MaxSize: 100, MaxFiles: 2})
+	for i := 0; i < 10; i++ {
+		l.Info.Printf("log line %v", i)
+	}
+
+	current, err := ioutil.ReadFile(filepath.Join(dir, "agent.log"))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(current), "INFO  log line 9\n"), string(current))
+	assert.True(t, len(current) <= 100)
+	_, err = os.Stat(filepath.Join(dir, "agent.log.1"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "agent.log.2"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "agent.log.3"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = ParseLogLevel("verbose")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResendReportUntilServerAcknowledgesIt(t *testing.T) {
+	testAgent.Config().SendMessageTimeout = 100 * time.Millisecond
+	defer func() {
+		testAgent.Config().SendMessageTimeout = 120 * time.Second
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.DropAcks(protocol.ReportCompletedAction, 2)
+	goServer.SendBuild(testAgent.Id(), buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestReportLostWithConnectionIsSentAfterReconnect(t *testing.T) {
+	reconnect := setUpReconnectingAgent(t)
+	defer tearDown()
+
+	goServer.DropMessages(protocol.ReportCompletedAction, 1)
+	goServer.SendBuild(testAgent.Id(), buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	time.Sleep(200 * time.Millisecond)
+	goServer.Disconnect(testAgent.Id())
+	reconnect <- true
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestReceivingStopsWhenConnectionIsClosedWhileServerKeepsSending(t *testing.T) {
+	config := *testAgent.Config()
+	config.AgentCount = 2
+	a, err := NewAgent(config.AgentConfigs()[1])
+	assert.Nil(t, err)
+	defer removeTestAgents([]*Agent{a})
+	var logs lockedBuffer
+	a.SetLogger(NewLogger(LogOptions{Output: &logs, Level: LevelDebug, Format: LogFormatText}))
+
+	buildId = callerName(1)
+	stateLog.Reset(buildId, a.Id())
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Start()
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	goServer.Send(a.Id(), protocol.ReregisterMessage())
+	for i := 0; i < 20; i++ {
+		goServer.Send(a.Id(), protocol.AckMessage(Sprintf("stray-%v", i)))
+		goServer.Send(a.Id(), protocol.SetCookieMessage("cookie"))
+	}
+	<-stopped
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "! exit goroutine: receive message") {
+		if time.Now().After(deadline) {
+			t.Fatal("receive goroutine did not exit after connection is closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, strings.Contains(logs.String(), "! exit goroutine: send message"))
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestUnknownMessageActionIsReportedBackToServer(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.Send(testAgent.Id(), &protocol.Message{Action: "fancy", AckId: "fancy-1"})
+	assert.Equal(t, "messageError fancy", stateLog.Next())
+
+	goServer.SendBuild(testAgent.Id(), buildId, echo("still working"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestMalformedBuildMessageIsRejectedWithoutStartingBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.Send(testAgent.Id(), &protocol.Message{Action: protocol.BuildAction, Data: `{"BuildId": `})
+	assert.Equal(t, "messageError build", stateLog.Next())
+	goServer.Send(testAgent.Id(), &protocol.Message{Action: protocol.BuildAction, Data: `{"BuildId": "no-command"}`})
+	assert.Equal(t, "messageError build", stateLog.Next())
+	assert.Equal(t, "Idle", testAgent.GetState("runtimeStatus"))
+}
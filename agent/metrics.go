@@ -0,0 +1,76 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/metrics"
+	"net/http"
+	"time"
+)
+
+// Metrics of all agents in the process, each labeled by agent id.
+var (
+	Metrics = metrics.NewRegistry()
+
+	buildsTotal = Metrics.NewCounter("gocd_agent_builds_total",
+		"Builds finished by result.", "agent", "result")
+	buildDuration = Metrics.NewHistogram("gocd_agent_build_duration_seconds",
+		"Build duration by result.", metrics.DefaultBuckets, "agent", "result")
+	commandDuration = Metrics.NewHistogram("gocd_agent_command_duration_seconds",
+		"Build command duration by command name.", metrics.DefaultBuckets, "agent", "command")
+	artifactUploadBytes = Metrics.NewCounter("gocd_agent_artifact_upload_bytes_total",
+		"Bytes of zipped artifacts uploaded to Go server.", "agent")
+	artifactUploadRetries = Metrics.NewCounter("gocd_agent_artifact_upload_retries_total",
+		"Artifact upload attempts retried.", "agent")
+	artifactDownloadBytes = Metrics.NewCounter("gocd_agent_artifact_download_bytes_total",
+		"Bytes of artifacts downloaded from Go server.", "agent")
+	artifactDownloadRetries = Metrics.NewCounter("gocd_agent_artifact_download_retries_total",
+		"Artifact download attempts retried.", "agent")
+	consoleFlushFailures = Metrics.NewCounter("gocd_agent_console_flush_failures_total",
+		"Build console log uploads failed.", "agent")
+	reconnectsTotal = Metrics.NewCounter("gocd_agent_reconnects_total",
+		"Websocket connections made after the first one.", "agent")
+	ackTimeouts = Metrics.NewCounter("gocd_agent_message_ack_timeouts_total",
+		"Messages Go server did not acknowledge in time.", "agent")
+	messageResends = Metrics.NewCounter("gocd_agent_message_resends_total",
+		"Messages sent again because Go server did not acknowledge them.", "agent")
+	messageErrors = Metrics.NewCounter("gocd_agent_message_errors_total",
+		"Messages from Go server agent could not decode or does not know.", "agent")
+	serverSilenceTimeouts = Metrics.NewCounter("gocd_agent_server_silence_timeouts_total",
+		"Websocket connections closed because Go server stopped answering.", "agent")
+)
+
+// initMetrics makes counters of agent show up with zero before
+// anything is counted.
+func initMetrics(agentId string) {
+	for _, c := range []*metrics.Counter{artifactUploadBytes, artifactUploadRetries,
+		artifactDownloadBytes, artifactDownloadRetries, consoleFlushFailures, reconnectsTotal,
+		ackTimeouts, messageResends, messageErrors, serverSilenceTimeouts} {
+		c.Add(0, agentId)
+	}
+}
+
+func observeSince(h *metrics.Histogram, start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *adminHandler) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := Metrics.Write(w); err != nil {
+		h.logger.Error.Printf("write metrics failed: %v", err)
+	}
+}
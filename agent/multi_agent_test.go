@@ -0,0 +1,101 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAgentConfigsKeepEachAgentInItsOwnDirectory(t *testing.T) {
+	config := *testAgent.Config()
+	assert.Equal(t, 1, len(config.AgentConfigs()))
+
+	config.AgentCount = 2
+	configs := config.AgentConfigs()
+	assert.Equal(t, 2, len(configs))
+	assert.NotEqual(t, configs[0].WorkingDir, configs[1].WorkingDir)
+	assert.NotEqual(t, configs[0].AgentIdFile, configs[1].AgentIdFile)
+	assert.NotEqual(t, configs[0].AgentCertFile, configs[1].AgentCertFile)
+	assert.NotEqual(t, configs[0].LogFile, configs[1].LogFile)
+	assert.True(t, configs[0].Servers != configs[1].Servers)
+}
+
+func TestAgentsInOneProcessRunTheirOwnBuilds(t *testing.T) {
+	agents := newTestAgents(t, 2)
+	defer removeTestAgents(agents)
+	assert.NotEqual(t, agents[0].Id(), agents[1].Id())
+
+	stopped := make(chan bool)
+	for _, a := range agents {
+		stateLog.Reset("", a.Id())
+		go func(a *Agent) {
+			a.Start()
+			stopped <- true
+		}(a)
+		assert.Equal(t, "agent Idle", stateLog.Next())
+	}
+
+	for i, a := range agents {
+		buildId = Sprintf("%v-%v", callerName(1), i)
+		stateLog.Reset(buildId, a.Id())
+		goServer.SendBuild(a.Id(), buildId, echo("hello from "+a.Id()))
+		assert.Equal(t, "agent Building", stateLog.Next())
+		assert.Equal(t, "build Passed", stateLog.Next())
+		assert.Equal(t, "agent Idle", stateLog.Next())
+		log, err := goServer.ConsoleLog(buildId)
+		assert.Nil(t, err)
+		assert.Equal(t, Sprintf("hello from %v\n", a.Id()), trimTimestamp(log))
+	}
+
+	for _, a := range agents {
+		goServer.Send(a.Id(), protocol.ReregisterMessage())
+		<-stopped
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	AdminHandler(agents...).ServeHTTP(rec, req)
+	for _, a := range agents {
+		sample := Sprintf("\ngocd_agent_builds_total{agent=%q,result=\"Passed\"} 1\n", a.Id())
+		assert.True(t, contains(rec.Body.String(), sample), rec.Body.String())
+	}
+}
+
+func newTestAgents(t *testing.T, count int) []*Agent {
+	config := *testAgent.Config()
+	config.AgentCount = count + 1
+	var agents []*Agent
+	for _, c := range config.AgentConfigs()[1:] {
+		a, err := NewAgent(c)
+		assert.Nil(t, err)
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+func removeTestAgents(agents []*Agent) {
+	for _, a := range agents {
+		os.RemoveAll(a.Config().WorkingDir)
+		os.RemoveAll(a.Config().ConfigDir)
+	}
+}
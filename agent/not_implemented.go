@@ -18,9 +18,16 @@ package agent
 
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"reflect"
 )
 
 func NotImplemented(s *BuildSession, cmd *protocol.BuildCommand) error {
 	s.warn("Golang Agent does not support build comamnd '%v' yet, related GoCD feature will not be supported. More details: https://github.com/gocd-contrib/gocd-golang-agent", cmd.Name)
 	return nil
 }
+
+// isNotImplemented tells whether executor is NotImplemented, which only
+// warns and does not run the command.
+func isNotImplemented(executor Executor) bool {
+	return reflect.ValueOf(executor).Pointer() == reflect.ValueOf(NotImplemented).Pointer()
+}
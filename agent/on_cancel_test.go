@@ -26,7 +26,7 @@ import (
 func TestOnCancel1(t *testing.T) {
 	setUp(t)
 	defer tearDown()
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.ComposeCommand(
 			echo("echo before sleep"),
 			protocol.ExecCommand("sleep", "5").SetOnCancel(echo("read on cancel")),
@@ -37,7 +37,7 @@ func TestOnCancel1(t *testing.T) {
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 
-	goServer.Send(AgentId, protocol.CancelMessage())
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
 
 	assert.Equal(t, "build Cancelled", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -61,13 +61,13 @@ func TestOnCancel2(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 	cancel := protocol.ExecCommand("sleep", "60")
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.ExecCommand("sleep", "5").SetOnCancel(cancel),
 	)
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 
-	goServer.Send(AgentId, protocol.CancelMessage())
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
 
 	assert.Equal(t, "build Cancelled", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -83,14 +83,14 @@ func TestOnCancel2(t *testing.T) {
 func TestOnCancelShouldContinueMaskEchos(t *testing.T) {
 	setUp(t)
 	defer tearDown()
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.SecretCommand("secret", "$$$"),
 		protocol.ExecCommand("sleep", "5").SetOnCancel(echo("secret on cancel: ${agent.location}")),
 	)
 
 	assert.Equal(t, "agent Building", stateLog.Next())
 
-	goServer.Send(AgentId, protocol.CancelMessage())
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
 
 	assert.Equal(t, "build Cancelled", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -98,7 +98,7 @@ func TestOnCancelShouldContinueMaskEchos(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	config := GetConfig()
+	config := testAgent.Config()
 	expected := Sprintf("$$$ on cancel: %v\n", config.WorkingDir)
 	assert.Equal(t, expected, trimTimestamp(log))
 }
@@ -108,13 +108,13 @@ func TestCancelBuildWhenBuildIsHangingOnTestCommand(t *testing.T) {
 	defer tearDown()
 
 	testCmd := protocol.ExecCommand("sleep", "5")
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		echo("hello before cancel"),
 		echo("hello after sleep 5").SetTest(testCmd),
 	)
 	assert.Equal(t, "agent Building", stateLog.Next())
 
-	goServer.Send(AgentId, protocol.CancelMessage())
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
 
 	assert.Equal(t, "build Cancelled", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"context"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOneShotAgentStopsAfterFirstBuild(t *testing.T) {
+	testAgent.Config().OneShot = true
+	defer func() {
+		testAgent.Config().OneShot = false
+	}()
+	stopped := startOneShotAgent(t)
+
+	goServer.SendBuild(testAgent.Id(), buildId, echo("hello"), protocol.FailCommand("bye"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("one-shot agent did not stop after build")
+	}
+	assert.Equal(t, protocol.BuildFailed, testAgent.LastBuildStatus())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\nERROR: bye\n", trimTimestamp(log))
+}
+
+func TestOneShotAgentDeliversReportOfBuildFinishedWhileDisconnected(t *testing.T) {
+	var serverDown int32
+	a := newOneShotAgent(t, func(c *Config) {
+		c.Proxy = func(*url.URL) (*url.URL, error) {
+			if atomic.LoadInt32(&serverDown) == 1 {
+				return nil, Err("server is down")
+			}
+			return nil, nil
+		}
+	})
+	defer removeTestAgents([]*Agent{a})
+	stopped := runOneShotAgent(t, a)
+
+	goServer.SendBuild(a.Id(), buildId, protocol.ExecCommand("sleep", "0.3"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	atomic.StoreInt32(&serverDown, 1)
+	goServer.Disconnect(a.Id())
+	time.Sleep(600 * time.Millisecond)
+	atomic.StoreInt32(&serverDown, 0)
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("one-shot agent did not stop after delivering build report")
+	}
+	assert.Equal(t, protocol.BuildPassed, a.LastBuildStatus())
+}
+
+func TestOneShotAgentGivesUpWhenServerDoesNotAcknowledgeReport(t *testing.T) {
+	a := newOneShotAgent(t, func(c *Config) {
+		c.SendMessageTimeout = 300 * time.Millisecond
+	})
+	defer removeTestAgents([]*Agent{a})
+	goServer.DropAcks(protocol.ReportCompletedAction, 1000)
+	defer goServer.DropAcks(protocol.ReportCompletedAction, 0)
+	stopped := runOneShotAgent(t, a)
+
+	goServer.SendBuild(a.Id(), buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	select {
+	case err := <-stopped:
+		assert.Equal(t, ErrReportsUndelivered, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("one-shot agent waits for ack forever")
+	}
+}
+
+func newOneShotAgent(t *testing.T, configure func(c *Config)) *Agent {
+	config := *testAgent.Config()
+	config.AgentCount = 2
+	c := config.AgentConfigs()[1]
+	c.OneShot = true
+	c.Reconnect = ReconnectPolicy{BaseDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	configure(c)
+	a, err := NewAgent(c)
+	assert.Nil(t, err)
+	return a
+}
+
+func runOneShotAgent(t *testing.T, a *Agent) chan error {
+	buildId = callerName(2)
+	stateLog.Reset(buildId, a.Id())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- a.Run(context.Background())
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	return stopped
+}
+
+func TestAgentStopsWhenNoBuildArrivesBeforeIdleTimeout(t *testing.T) {
+	testAgent.Config().IdleTimeout = 200 * time.Millisecond
+	defer func() {
+		testAgent.Config().IdleTimeout = 0
+	}()
+	stopped := make(chan error)
+	go func() {
+		stopped <- testAgent.Start()
+	}()
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop after idle timeout")
+	}
+}
+
+func startOneShotAgent(t *testing.T) chan error {
+	buildId = callerName(2)
+	stateLog.Reset(buildId, testAgent.Id())
+	stopped := make(chan error)
+	go func() {
+		stopped <- testAgent.Start()
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	return stopped
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+)
+
+// Outbox decouples build sessions from the websocket connection.
+// Messages are forwarded to the attached connection, and build reports
+// are queued while there is no connection and replayed once a new
+// connection is attached.
+type Outbox struct {
+	Send     chan *protocol.Message
+	attach   chan chan *protocol.Message
+	attached chan bool
+	detach   chan bool
+	requeue  chan []*protocol.Message
+	pending  chan chan int
+	logger   *Logger
+}
+
+func NewOutbox(logger *Logger) *Outbox {
+	outbox := &Outbox{
+		Send:     make(chan *protocol.Message),
+		attach:   make(chan chan *protocol.Message),
+		attached: make(chan bool),
+		detach:   make(chan bool),
+		requeue:  make(chan []*protocol.Message),
+		pending:  make(chan chan int),
+		logger:   logger,
+	}
+	go outbox.run()
+	return outbox
+}
+
+func (o *Outbox) Attach(conn chan *protocol.Message) {
+	o.attach <- conn
+	<-o.attached
+}
+
+func (o *Outbox) Detach() {
+	o.detach <- true
+}
+
+// Requeue puts reports a broken connection did not deliver in front
+// of the queue, they are sent again once a connection is attached.
+func (o *Outbox) Requeue(msgs []*protocol.Message) {
+	if len(msgs) > 0 {
+		o.requeue <- msgs
+	}
+}
+
+// Pending returns the number of reports queued until a connection is
+// attached.
+func (o *Outbox) Pending() int {
+	n := make(chan int)
+	o.pending <- n
+	return <-n
+}
+
+func (o *Outbox) run() {
+	var conn chan *protocol.Message
+	var queue []*protocol.Message
+	for {
+		select {
+		case conn = <-o.attach:
+			if len(queue) > 0 {
+				o.logger.Info.Printf("replay %v queued messages", len(queue))
+			}
+			for _, msg := range queue {
+				conn <- msg
+			}
+			queue = nil
+			o.attached <- true
+		case <-o.detach:
+			conn = nil
+		case n := <-o.pending:
+			n <- len(queue)
+		case msgs := <-o.requeue:
+			o.logger.Info.Printf("queue %v unacknowledged messages", len(msgs))
+			queue = append(msgs, queue...)
+		case msg := <-o.Send:
+			if conn != nil {
+				conn <- msg
+			} else if isReportMessage(msg) {
+				o.logger.Info.Printf("connection is down, queue message: %v", msg.Action)
+				queue = append(queue, msg)
+			} else {
+				o.logger.Debug.Printf("connection is down, drop message: %v", msg.Action)
+			}
+		}
+	}
+}
+
+func isReportMessage(msg *protocol.Message) bool {
+	switch msg.Action {
+	case protocol.ReportCurrentStatusAction,
+		protocol.ReportCompletingAction,
+		protocol.ReportCompletedAction:
+		return true
+	}
+	return false
+}
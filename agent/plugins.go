@@ -0,0 +1,139 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// PluginCommandsTimeout bounds how long a plugin may take to list its
+// commands, a plugin that does not answer in time is skipped.
+var PluginCommandsTimeout = 10 * time.Second
+
+// PluginRequest is written as JSON to stdin of a plugin run with the
+// "run" argument. Output of the plugin goes to the build console, and
+// a non-zero exit status fails the command.
+type PluginRequest struct {
+	Command    *protocol.BuildCommand `json:"command"`
+	WorkingDir string                 `json:"workingDir"`
+	Env        []string               `json:"env"`
+}
+
+// LoadPlugins finds executables in dir and asks each of them for the
+// build command names it handles: run with the "commands" argument, a
+// plugin prints a JSON array of names to stdout. Result maps command
+// name to plugin path.
+func LoadPlugins(dir string) (map[string]string, []error) {
+	plugins := make(map[string]string)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return plugins, nil
+		}
+		return plugins, []error{err}
+	}
+	var errs []error
+	for _, f := range files {
+		if f.IsDir() || f.Mode()&0111 == 0 {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		names, err := pluginCommands(path)
+		if err != nil {
+			errs = append(errs, Err("plugin %v: %v", path, err))
+			continue
+		}
+		for _, name := range names {
+			if other, ok := plugins[name]; ok {
+				errs = append(errs, Err("plugin %v: command %v is already handled by %v", path, name, other))
+				continue
+			}
+			plugins[name] = path
+		}
+	}
+	return plugins, errs
+}
+
+func pluginCommands(path string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PluginCommandsTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "commands")
+	cmd.Stderr = &stderr
+	// processes the plugin started may keep stdout open after it is killed
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, Err("no command list in %v, plugin is killed", PluginCommandsTimeout)
+	}
+	if err != nil {
+		return nil, Err("%v %v", err, stderr.String())
+	}
+	var names []string
+	if err := json.Unmarshal(out, &names); err != nil {
+		return nil, Err("invalid command list: %v", err)
+	}
+	return names, nil
+}
+
+// PluginExecutor runs build commands by the plugin at path.
+func PluginExecutor(path string) Executor {
+	return func(s *BuildSession, cmd *protocol.BuildCommand) error {
+		env := s.Env()
+		request, err := json.Marshal(&PluginRequest{Command: cmd, WorkingDir: s.wd, Env: env})
+		if err != nil {
+			return err
+		}
+		execCmd := exec.Command(path, "run")
+		execCmd.Env = env
+		execCmd.Stdin = bytes.NewReader(request)
+		execCmd.Stdout = s.secrets
+		execCmd.Stderr = s.secrets
+		execCmd.Dir = s.wd
+		return runProcess(s, execCmd, Sprintf("%v %v", filepath.Base(path), cmd.Name))
+	}
+}
+
+func (a *Agent) loadPlugins() {
+	plugins, errs := LoadPlugins(a.Config().PluginsDir)
+	for _, err := range errs {
+		a.logger.Error.Printf("load plugins failed: %v", err)
+	}
+	builtin := Executors()
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := builtin[name]; ok {
+			a.logger.Warn.Printf("plugin %v can't replace built-in command %v", plugins[name], name)
+			continue
+		}
+		a.logger.Info.Printf("plugin %v handles command %v", plugins[name], name)
+		a.RegisterExecutor(name, PluginExecutor(plugins[name]))
+	}
+}
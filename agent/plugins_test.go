@@ -0,0 +1,164 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPlugin = `#!/bin/sh
+case "$1" in
+commands)
+	echo '["greet", "nap"]'
+	;;
+run)
+	cat
+	echo
+	[ -n "$FAIL_PLUGIN" ] && exit 3
+	sleep "${NAP:-0}"
+	;;
+esac
+`
+
+func createTestPlugin(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "plugins")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "test-plugin"), []byte(testPlugin), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644))
+	return dir
+}
+
+func TestLoadPluginsAsksExecutablesForCommandNames(t *testing.T) {
+	dir := createTestPlugin(t)
+	defer os.RemoveAll(dir)
+
+	plugins, errs := LoadPlugins(dir)
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 2, len(plugins))
+	assert.Equal(t, filepath.Join(dir, "test-plugin"), plugins["greet"])
+	assert.Equal(t, filepath.Join(dir, "test-plugin"), plugins["nap"])
+
+	plugins, errs = LoadPlugins(filepath.Join(dir, "not-exist"))
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 0, len(plugins))
+}
+
+func TestLoadPluginsSkipsPluginThatDoesNotAnswer(t *testing.T) {
+	dir := createTestPlugin(t)
+	defer os.RemoveAll(dir)
+	hanging := "#!/bin/sh\nsleep 30\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "hanging-plugin"), []byte(hanging), 0755))
+	defer func(timeout time.Duration) { PluginCommandsTimeout = timeout }(PluginCommandsTimeout)
+	PluginCommandsTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	plugins, errs := LoadPlugins(dir)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, contains(errs[0].Error(), "hanging-plugin: no command list in 100ms"), errs[0])
+	assert.Equal(t, 2, len(plugins))
+}
+
+func TestAgentLoadsPluginsWhenItStarts(t *testing.T) {
+	dir := createTestPlugin(t)
+	defer os.RemoveAll(dir)
+	config := *testAgent.Config()
+	config.AgentCount = 2
+	c := config.AgentConfigs()[1]
+	c.PluginsDir = dir
+	a, err := NewAgent(c)
+	assert.Nil(t, err)
+	defer removeTestAgents([]*Agent{a})
+	assert.False(t, contains(strings.Join(a.SupportedCommands(), ","), "greet"))
+
+	stateLog.Reset("", a.Id())
+	stopped := make(chan bool)
+	go func() {
+		a.Start()
+		close(stopped)
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.True(t, contains(strings.Join(a.SupportedCommands(), ","), "greet"))
+	goServer.Send(a.Id(), protocol.ReregisterMessage())
+	<-stopped
+}
+
+func TestPluginRunsBuildCommandWithMaskedOutput(t *testing.T) {
+	dir := createTestPlugin(t)
+	defer os.RemoveAll(dir)
+	testAgent.RegisterExecutor("greet", PluginExecutor(filepath.Join(dir, "test-plugin")))
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.NewBuildCommand(protocol.CommandSecret).AddArg("value", "s3cr3t"),
+		protocol.NewBuildCommand("greet").AddArg("name", "s3cr3t"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, `"command":{"Name":"greet","Args":{"name":"********"}`), log)
+	assert.True(t, contains(log, `"workingDir":"`+testAgent.Config().WorkingDir+`"`), log)
+}
+
+func TestPluginFailsBuildWithNonZeroExit(t *testing.T) {
+	dir := createTestPlugin(t)
+	defer os.RemoveAll(dir)
+	testAgent.RegisterExecutor("greet", PluginExecutor(filepath.Join(dir, "test-plugin")))
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.NewBuildCommand(protocol.CommandExport).AddArg("name", "FAIL_PLUGIN").AddArg("value", "t"),
+		protocol.NewBuildCommand("greet"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "ERROR: exit status 3"), log)
+}
+
+func TestPluginIsKilledWhenBuildIsCanceled(t *testing.T) {
+	dir := createTestPlugin(t)
+	defer os.RemoveAll(dir)
+	testAgent.RegisterExecutor("nap", PluginExecutor(filepath.Join(dir, "test-plugin")))
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.NewBuildCommand(protocol.CommandExport).AddArg("name", "NAP").AddArg("value", "5"),
+		protocol.NewBuildCommand("nap"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	goServer.Send(testAgent.Id(), protocol.CancelMessage())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
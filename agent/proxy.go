@@ -0,0 +1,111 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"golang.org/x/net/http/httpproxy"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// NewProxyFunc picks proxy by HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables, proxyUrl replaces HTTPS_PROXY when given.
+// Requests to localhost are never proxied.
+func NewProxyFunc(proxyUrl string) func(*url.URL) (*url.URL, error) {
+	c := httpproxy.FromEnvironment()
+	if proxyUrl != "" {
+		c.HTTPSProxy = proxyUrl
+	}
+	return c.ProxyFunc()
+}
+
+// DialTunnel opens a connection to addr through proxy by HTTP CONNECT,
+// with basic auth when proxy url has user info.
+func DialTunnel(proxy *url.URL, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxy.Scheme == "https" {
+		conn, err = tls.Dial("tcp", proxyHostAndPort(proxy), &tls.Config{ServerName: proxy.Hostname()})
+	} else {
+		conn, err = net.Dial("tcp", proxyHostAndPort(proxy))
+	}
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, Err("proxy %v refused to connect to %v: %v", proxy.Host, addr, resp.Status)
+	}
+	return conn, nil
+}
+
+func proxyHostAndPort(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	if proxy.Scheme == "https" {
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// dialGoServer makes a TLS connection to Go server, tunneled through
+// proxy when there is one for the server.
+func (c *Config) dialGoServer(server *url.URL, tlsConfig *tls.Config) (*tls.Conn, error) {
+	proxy, err := c.Proxy(server)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return tls.Dial("tcp", server.Host, tlsConfig)
+	}
+	conn, err := DialTunnel(proxy, server.Host)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTunnelToGoServerThroughProxyWithBasicAuth(t *testing.T) {
+	proxy := startTestProxy(t, "agent:secret")
+	defer proxy.Close()
+	serverAddr := strings.TrimPrefix(goServerUrl, "https://")
+
+	proxyUrl, _ := url.Parse("http://agent:secret@" + proxy.Addr().String())
+	conn, err := DialTunnel(proxyUrl, serverAddr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	req, _ := http.NewRequest(http.MethodGet, goServerUrl+server.StatusPath, nil)
+	assert.Nil(t, req.Write(tlsConn))
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{serverAddr}, proxy.Connects())
+}
+
+func TestTunnelFailsWhenProxyRejectsCredentials(t *testing.T) {
+	proxy := startTestProxy(t, "agent:secret")
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse("http://agent:wrong@" + proxy.Addr().String())
+	_, err := DialTunnel(proxyUrl, strings.TrimPrefix(goServerUrl, "https://"))
+	assert.NotNil(t, err)
+	assert.True(t, contains(err.Error(), "407"), err)
+	assert.Equal(t, 0, len(proxy.Connects()))
+}
+
+func TestProxyFuncHonoursNoProxy(t *testing.T) {
+	noProxy := os.Getenv("NO_PROXY")
+	defer os.Setenv("NO_PROXY", noProxy)
+	os.Setenv("NO_PROXY", "internal.example.com")
+
+	proxy := NewProxyFunc("http://proxy.example.com:3128")
+	u, err := proxy(&url.URL{Scheme: "https", Host: "gocd.example.com:8154"})
+	assert.Nil(t, err)
+	assert.Equal(t, "proxy.example.com:3128", u.Host)
+
+	u, err = proxy(&url.URL{Scheme: "https", Host: "internal.example.com:8154"})
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+}
+
+type testProxy struct {
+	net.Listener
+	auth     string
+	mu       sync.Mutex
+	connects []string
+}
+
+func startTestProxy(t *testing.T, auth string) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{Listener: l, auth: auth}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) Connects() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connects
+}
+
+func (p *testProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.auth))
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != expected {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	p.mu.Lock()
+	p.connects = append(p.connects, req.Host)
+	p.mu.Unlock()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, reader)
+	io.Copy(conn, target)
+}
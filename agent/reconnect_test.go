@@ -0,0 +1,136 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuildKeepsRunningAcrossReconnect(t *testing.T) {
+	reconnect := setUpReconnectingAgent(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		echo("before disconnect"),
+		protocol.ExecCommand("sleep", "1"),
+		echo("after reconnect"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	goServer.Disconnect(testAgent.Id())
+	time.Sleep(1500 * time.Millisecond)
+	reconnect <- true
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "before disconnect\nafter reconnect\n", trimTimestamp(log))
+}
+
+func TestCancelBuildWhenAgentDoesNotReconnectInTime(t *testing.T) {
+	testAgent.Config().ReconnectBuildTimeout = 100 * time.Millisecond
+	defer func() {
+		testAgent.Config().ReconnectBuildTimeout = 10 * time.Minute
+	}()
+	reconnect := setUpReconnectingAgent(t)
+	defer tearDown()
+
+	goServer.SendBuild(testAgent.Id(), buildId,
+		protocol.ExecCommand("sleep", "5").SetOnCancel(echo("canceled")),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	goServer.Disconnect(testAgent.Id())
+	time.Sleep(500 * time.Millisecond)
+	reconnect <- true
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "canceled\n", trimTimestamp(log))
+}
+
+func TestShutdownCancelsBuildAfterGracePeriodWhenServerIsDown(t *testing.T) {
+	config := *testAgent.Config()
+	config.AgentCount = 2
+	c := config.AgentConfigs()[1]
+	c.ShutdownGracePeriod = 500 * time.Millisecond
+	c.Reconnect = ReconnectPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	var serverDown int32
+	c.Proxy = func(*url.URL) (*url.URL, error) {
+		if atomic.LoadInt32(&serverDown) == 1 {
+			return nil, Err("server is down")
+		}
+		return nil, nil
+	}
+	a, err := NewAgent(c)
+	assert.Nil(t, err)
+	defer removeTestAgents([]*Agent{a})
+	var logs bytes.Buffer
+	a.SetLogger(NewLogger(LogOptions{Output: &logs, Level: LevelInfo, Format: LogFormatText}))
+
+	buildId = callerName(1)
+	stateLog.Reset(buildId, a.Id())
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Run(context.Background())
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	goServer.SendBuild(a.Id(), buildId, protocol.ExecCommand("sleep", "10"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	atomic.StoreInt32(&serverDown, 1)
+	goServer.Disconnect(a.Id())
+	a.Shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not cancel build after shutdown grace period")
+	}
+	output := logs.String()
+	assert.True(t, contains(output, "build did not finish in 500ms, cancel it"), output)
+	assert.True(t, strings.Count(output, "and restart") < 20, output)
+}
+
+func setUpReconnectingAgent(t *testing.T) chan bool {
+	buildId = callerName(2)
+	stateLog.Reset(buildId, testAgent.Id())
+	reconnect := make(chan bool)
+	agentStopped = make(chan bool)
+	go func() {
+		for {
+			err := testAgent.Start()
+			if err.Error() == "received reregister message" {
+				close(agentStopped)
+				return
+			}
+			<-reconnect
+		}
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	return reconnect
+}
@@ -29,25 +29,32 @@ import (
 	"runtime"
 )
 
-func ReadGoServerCACert() error {
-	_, err := os.Stat(config.GoServerCAFile)
+var ErrRegistrationPending = Err("Register failed, probably need approve agent registration on Server side")
+
+func (a *Agent) ReadGoServerCACert() error {
+	return a.readGoServerCACert(a.Config().ServerUrl())
+}
+
+func (a *Agent) readGoServerCACert(server *url.URL) error {
+	caFile := a.Config().ServerCAFile(server)
+	_, err := os.Stat(caFile)
 	if err == nil {
 		return nil
 	}
 
-	LogInfo("fetching Go server[%v] CA certificate", config.ServerHostAndPort)
-	conn, err := tls.Dial("tcp", config.ServerHostAndPort, &tls.Config{
+	a.logger.Info.Printf("fetching Go server[%v] CA certificate", server.Host)
+	conn, err := a.Config().dialGoServer(server, &tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
-		logger.Error.Printf("failed to connect: " + err.Error())
+		a.logger.Error.Printf("failed to connect: " + err.Error())
 		return err
 	}
 	defer conn.Close()
 	state := conn.ConnectionState()
-	certOut, err := os.Create(config.GoServerCAFile)
+	certOut, err := os.Create(caFile)
 	if err != nil {
-		logger.Error.Printf("failed to open %v for writing: %s", config.GoServerCAFile, err)
+		a.logger.Error.Printf("failed to open %v for writing: %s", caFile, err)
 		return err
 	}
 	defer certOut.Close()
@@ -55,8 +62,12 @@ func ReadGoServerCACert() error {
 	return nil
 }
 
-func GoServerRootCAs() (*x509.CertPool, error) {
-	caCert, err := ioutil.ReadFile(config.GoServerCAFile)
+func (a *Agent) GoServerRootCAs() (*x509.CertPool, error) {
+	return goServerRootCAs(a.Config().GoServerCAFile())
+}
+
+func goServerRootCAs(caFile string) (*x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(caFile)
 	if err != nil {
 		return nil, err
 	}
@@ -68,20 +79,25 @@ func GoServerRootCAs() (*x509.CertPool, error) {
 	return roots, nil
 }
 
-func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
+func (a *Agent) GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
+	return a.goServerTlsConfig(a.Config().ServerUrl(), withClientCert)
+}
+
+func (a *Agent) goServerTlsConfig(server *url.URL, withClientCert bool) (*tls.Config, error) {
 	certs := make([]tls.Certificate, 0)
 	if withClientCert {
-		cert, err := tls.LoadX509KeyPair(config.AgentCertFile, config.AgentPrivateKeyFile)
+		cert, err := tls.LoadX509KeyPair(a.Config().AgentCertFile, a.Config().AgentPrivateKeyFile)
 		if err != nil {
 			return nil, err
 		}
 		certs = append(certs, cert)
 	}
-	roots, err := GoServerRootCAs()
+	caFile := a.Config().ServerCAFile(server)
+	roots, err := goServerRootCAs(caFile)
 	if err != nil {
 		return nil, err
 	}
-	serverName, err := extractServerDN(config.GoServerCAFile)
+	serverName, err := extractServerDN(caFile)
 	if err != nil {
 		return nil, err
 	}
@@ -92,31 +108,36 @@ func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	}, nil
 }
 
-func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
-	config, err := GoServerTlsConfig(withClientCert)
-	if err != nil {
+func (a *Agent) GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
+	if _, err := a.GoServerTlsConfig(withClientCert); err != nil {
 		return nil, err
 	}
-	tr := &http.Transport{
-		TLSClientConfig: config,
-	}
-	return &http.Client{Transport: tr}, nil
+	return &http.Client{Transport: newFailoverTransport(a, withClientCert)}, nil
 }
 
-func Register() error {
-	if err := ReadGoServerCACert(); err != nil {
+func (a *Agent) Register() error {
+	var err error
+	for i := 0; i < a.Config().Servers.Len(); i++ {
+		server := a.Config().ServerUrl()
+		if err = a.readGoServerCACert(server); err == nil {
+			break
+		}
+		a.failoverFrom(server)
+	}
+	if err != nil {
 		return err
 	}
-	if err := readAgentKeyAndCerts(registerData()); err != nil {
+	if err := a.readAgentKeyAndCerts(a.registerData()); err != nil {
 		return err
 	}
 	return nil
 }
 
-func CleanRegistration() error {
-	files := []string{config.GoServerCAFile,
-		config.AgentPrivateKeyFile,
-		config.AgentCertFile}
+func (a *Agent) CleanRegistration() error {
+	files := []string{a.Config().AgentPrivateKeyFile, a.Config().AgentCertFile}
+	for _, server := range a.Config().Servers.All() {
+		files = append(files, a.Config().ServerCAFile(server))
+	}
 	for _, f := range files {
 		_, err := os.Stat(f)
 		if err == nil {
@@ -129,25 +150,39 @@ func CleanRegistration() error {
 	return nil
 }
 
-func registerData() map[string]string {
+func (a *Agent) Unregister() error {
+	if err := a.CleanRegistration(); err != nil {
+		return err
+	}
+	if err := os.Remove(a.Config().AgentIdFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *Agent) ReadAgentCertificate() (*x509.Certificate, error) {
+	return readCertificate(a.Config().AgentCertFile)
+}
+
+func (a *Agent) registerData() map[string]string {
 	return map[string]string{
-		"hostname":                      config.Hostname,
-		"uuid":                          AgentId,
-		"location":                      config.WorkingDir,
+		"hostname":                      a.Config().Hostname,
+		"uuid":                          a.id,
+		"location":                      a.Config().WorkingDir,
 		"operatingSystem":               runtime.GOOS,
-		"usablespace":                   UsableSpaceString(),
-		"agentAutoRegisterKey":          config.AgentAutoRegisterKey,
-		"agentAutoRegisterResources":    config.AgentAutoRegisterResources,
-		"agentAutoRegisterEnvironments": config.AgentAutoRegisterEnvironments,
-		"agentAutoRegisterHostname":     config.Hostname,
-		"elasticAgentId":                config.AgentAutoRegisterElasticAgentId,
-		"elasticPluginId":               config.AgentAutoRegisterElasticPluginId,
+		"usablespace":                   UsableSpaceString(a.logger),
+		"agentAutoRegisterKey":          a.Config().AgentAutoRegisterKey,
+		"agentAutoRegisterResources":    a.Config().AgentAutoRegisterResources,
+		"agentAutoRegisterEnvironments": a.Config().AgentAutoRegisterEnvironments,
+		"agentAutoRegisterHostname":     a.Config().Hostname,
+		"elasticAgentId":                a.Config().AgentAutoRegisterElasticAgentId,
+		"elasticPluginId":               a.Config().AgentAutoRegisterElasticPluginId,
 	}
 }
 
-func readAgentKeyAndCerts(params map[string]string) error {
-	_, agentPrivateKeyFileErr := os.Stat(config.AgentPrivateKeyFile)
-	_, agentCertFileErr := os.Stat(config.AgentCertFile)
+func (a *Agent) readAgentKeyAndCerts(params map[string]string) error {
+	_, agentPrivateKeyFileErr := os.Stat(a.Config().AgentPrivateKeyFile)
+	_, agentCertFileErr := os.Stat(a.Config().AgentCertFile)
 	if agentPrivateKeyFileErr == nil && agentCertFileErr == nil {
 		return nil
 	}
@@ -157,13 +192,13 @@ func readAgentKeyAndCerts(params map[string]string) error {
 		form.Add(k, v)
 	}
 
-	client, err := GoServerRemoteClient(false)
+	client, err := a.GoServerRemoteClient(false)
 	if err != nil {
 		return err
 	}
 
-	url, err := config.RegistrationURL()
-	LogInfo("fetching agent key and certificates from: %v", url)
+	url, err := a.Config().RegistrationURL()
+	a.logger.Info.Printf("fetching agent key and certificates from: %v", url)
 	if err != nil {
 		return err
 	}
@@ -181,24 +216,31 @@ func readAgentKeyAndCerts(params map[string]string) error {
 		return err
 	}
 	if registration.AgentCertificate == "" {
-		return Err("Register failed, probably need approve agent registration on Server side")
+		return ErrRegistrationPending
 	}
 
-	ioutil.WriteFile(config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
-	ioutil.WriteFile(config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
+	ioutil.WriteFile(a.Config().AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
+	ioutil.WriteFile(a.Config().AgentCertFile, []byte(registration.AgentCertificate), 0600)
 	return nil
 }
 
 func extractServerDN(certFileName string) (string, error) {
-	pemBlock, err := ioutil.ReadFile(certFileName)
+	cert, err := readCertificate(certFileName)
 	if err != nil {
 		return "", err
 	}
+	return cert.Subject.CommonName, nil
+}
+
+func readCertificate(certFileName string) (*x509.Certificate, error) {
+	pemBlock, err := ioutil.ReadFile(certFileName)
+	if err != nil {
+		return nil, err
+	}
 
 	der, _ := pem.Decode(pemBlock)
-	cert, err := x509.ParseCertificate(der.Bytes)
-	if err != nil {
-		return "", err
+	if der == nil {
+		return nil, Err("no certificate found in %v", certFileName)
 	}
-	return cert.Subject.CommonName, nil
+	return x509.ParseCertificate(der.Bytes)
 }
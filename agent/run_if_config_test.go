@@ -16,7 +16,6 @@
 package agent_test
 
 import (
-	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/xli/assert"
 	"testing"
@@ -26,7 +25,7 @@ func TestRunIfConfig(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.EchoCommand("should not echo if failed when passed").RunIf("failed"),
 		protocol.EchoCommand("should echo if any when passed").RunIf("any"),
 		protocol.EchoCommand("should echo if passed when passed").RunIf("passed"),
@@ -56,7 +55,7 @@ func TestComposeCommandWithRunIfConfig(t *testing.T) {
 	setUp(t)
 	defer tearDown()
 
-	goServer.SendBuild(AgentId, buildId,
+	goServer.SendBuild(testAgent.Id(), buildId,
 		protocol.ComposeCommand(
 			protocol.ComposeCommand(
 				protocol.EchoCommand("hello world1"),
@@ -19,48 +19,54 @@ package agent
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"runtime"
-	"sync"
 )
 
-var state = map[string]string{
-	"runtimeStatus": "Idle",
+func (a *Agent) SetState(key, value string) {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	a.logger.Info.Printf("set %v to %v", key, value)
+	a.state[key] = value
 }
 
-var lock sync.Mutex
-
-func SetState(key, value string) {
-	lock.Lock()
-	defer lock.Unlock()
-	LogInfo("set %v to %v", key, value)
-	state[key] = value
+func (a *Agent) GetState(key string) string {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	return a.state[key]
 }
 
-func GetState(key string) string {
-	lock.Lock()
-	defer lock.Unlock()
-	return state[key]
+func (a *Agent) GetStates() map[string]string {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	states := make(map[string]string)
+	for k, v := range a.state {
+		states[k] = v
+	}
+	return states
 }
 
-func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
+func (a *Agent) GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
 	info := protocol.AgentRuntimeInfo{
 		Identifier: &protocol.AgentIdentifier{
-			HostName:  config.Hostname,
-			IpAddress: config.IpAddress,
-			Uuid:      AgentId,
+			HostName:  a.Config().Hostname,
+			IpAddress: a.Config().IpAddress,
+			Uuid:      a.id,
 		},
 		BuildingInfo: &protocol.AgentBuildingInfo{
-			BuildingInfo: GetState("buildLocatorForDisplay"),
-			BuildLocator: GetState("buildLocator"),
+			BuildingInfo: a.GetState("buildLocatorForDisplay"),
+			BuildLocator: a.GetState("buildLocator"),
 		},
-		RuntimeStatus:                GetState("runtimeStatus"),
-		Location:                     config.WorkingDir,
-		UsableSpace:                  UsableSpace(),
+		RuntimeStatus:                a.GetState("runtimeStatus"),
+		Location:                     a.Config().WorkingDir,
+		UsableSpace:                  UsableSpace(a.logger),
 		OperatingSystemName:          runtime.GOOS,
-		ElasticPluginId:              config.AgentAutoRegisterElasticPluginId,
-		ElasticAgentId:               config.AgentAutoRegisterElasticAgentId,
+		ElasticPluginId:              a.Config().AgentAutoRegisterElasticPluginId,
+		ElasticAgentId:               a.Config().AgentAutoRegisterElasticAgentId,
 		SupportsBuildCommandProtocol: true,
+		ProtocolVersion:              protocol.BuildCommandProtocolVersion,
+		SupportedCommands:            a.SupportedCommands(),
+		Features:                     []string{protocol.FeatureCrashRecovery, protocol.FeatureCommandTimeout},
 	}
-	if cookie := GetState("cookie"); cookie != "" {
+	if cookie := a.GetState("cookie"); cookie != "" {
 		info.Cookie = cookie
 	}
 	return &info
@@ -19,6 +19,7 @@ package agent
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
+	"sync"
 	"time"
 )
 
@@ -26,18 +27,56 @@ type WebsocketConnection struct {
 	Conn     *websocket.Conn
 	Send     chan *protocol.Message
 	Received chan *protocol.Message
+
+	sent      chan bool
+	closeSend sync.Once
+	closed    chan bool
+	closeOnce sync.Once
+	unacked   []*protocol.Message
+	logger    *Logger
 }
 
-func (wc *WebsocketConnection) Close() {
-	close(wc.Send)
-	err := wc.Conn.Close()
-	if err != nil {
-		logger.Error.Printf("Close websocket connection failed: %v", err)
+// MaxSendMessageTimeout caps how long agent waits for the ack of a
+// message that has been resent several times.
+var MaxSendMessageTimeout = 10 * time.Minute
+
+// Unacked waits until the connection stopped sending and returns the
+// reports Go server did not acknowledge.
+func (wc *WebsocketConnection) Unacked() []*protocol.Message {
+	<-wc.sent
+	return wc.unacked
+}
+
+// Drain stops sending and waits until messages already handed to the
+// connection are sent and acknowledged. A message is resent until it
+// is acknowledged, so Drain gives up after timeout and closes the
+// connection. It returns false when a report was not acknowledged,
+// Unacked returns those reports.
+func (wc *WebsocketConnection) Drain(timeout time.Duration) bool {
+	wc.closeSend.Do(func() { close(wc.Send) })
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wc.sent:
+	case <-timer.C:
+		wc.logger.Warn.Printf("messages are not acknowledged in %v, close connection", timeout)
+		wc.Close()
 	}
+	return len(wc.Unacked()) == 0
 }
 
-func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error) {
-	tlsConfig, err := GoServerTlsConfig(true)
+func (wc *WebsocketConnection) Close() {
+	wc.closeSend.Do(func() { close(wc.Send) })
+	wc.closeOnce.Do(func() {
+		close(wc.closed)
+		if err := wc.Conn.Close(); err != nil {
+			wc.logger.Error.Printf("Close websocket connection failed: %v", err)
+		}
+	})
+}
+
+func (a *Agent) MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error) {
+	tlsConfig, err := a.GoServerTlsConfig(true)
 	if err != nil {
 		return nil, err
 	}
@@ -46,82 +85,191 @@ func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error
 		return nil, err
 	}
 	wsConfig.TlsConfig = tlsConfig
-	LogInfo("connect to: %v", wsLoc)
-	ws, err := websocket.DialConfig(wsConfig)
+	wsConfig.Protocol = protocol.OfferCodec(a.Config().WebsocketCodec)
+	a.logger.Info.Printf("connect to: %v", wsLoc)
+	activity, ws, err := a.dialWebsocket(wsConfig)
 	if err != nil {
 		return nil, err
 	}
+	a.logger.Info.Printf("websocket codec: %v", protocol.Codec(ws))
+	a.reconnect.Healthy()
 	ack := make(chan string)
 	send := make(chan *protocol.Message)
 	received := make(chan *protocol.Message)
+	sent := make(chan bool)
+	broken := make(chan bool)
+
+	inbox := make(chan *protocol.Message)
 
-	go startReceiveMessage(ws, received, ack)
-	go startSendMessage(ws, send, ack)
-	return &WebsocketConnection{Conn: ws, Send: send, Received: received}, nil
+	wc := &WebsocketConnection{Conn: ws, Send: send, Received: received, sent: sent, closed: make(chan bool), logger: a.logger}
+	go a.startReceiveMessage(ws, inbox, ack, broken, wc.closed)
+	go a.watchServerSilence(ws, activity, a.Config().ServerSilenceTimeout, wc.closed)
+	go forwardMessages(inbox, received, wc.closed)
+	go func() {
+		defer close(sent)
+		wc.unacked = a.startSendMessage(ws, send, ack, broken)
+	}()
+	return wc, nil
 }
 
-func startSendMessage(ws *websocket.Conn, send chan *protocol.Message, ack chan string) {
-	defer LogDebug("! exit goroutine: send message")
+func (a *Agent) dialWebsocket(wsConfig *websocket.Config) (*activityConn, *websocket.Conn, error) {
+	conn, err := a.Config().dialGoServer(a.Config().ServerUrl(), wsConfig.TlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	activity := newActivityConn(conn)
+	ws, err := websocket.NewClient(wsConfig, activity)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return activity, ws, nil
+}
+
+// startSendMessage sends messages one by one and resends a message
+// until it is acknowledged, waiting longer after each timeout. Once
+// the connection is broken, it keeps reading send until it is closed,
+// and returns the reports that were not acknowledged.
+func (a *Agent) startSendMessage(ws *websocket.Conn, send chan *protocol.Message, ack chan string, broken chan bool) (unacked []*protocol.Message) {
+	defer a.logger.Debug.Printf("! exit goroutine: send message")
 	connClosed := false
-loop:
-	select {
-	case id := <-ack:
-		LogInfo("Ignore ack with id: %v", id)
-	case msg, ok := <-send:
-		if !ok {
-			return
-		}
-		LogInfo("--> %v", msg.Action)
-		if connClosed {
-			logger.Error.Printf("send message failed: connection is closed")
-			goto loop
-		}
-		if err := protocol.SendMessage(ws, msg); err == nil {
-			waitForMessageAck(msg.AckId, ack)
-			goto loop
-		} else {
-			logger.Error.Printf("send message failed: %v", err)
-			if err := ws.Close(); err == nil {
+	for {
+		select {
+		case id := <-ack:
+			a.logger.Info.Printf("Ignore ack with id: %v", id)
+		case <-broken:
+			broken = nil
+			connClosed = true
+		case msg, ok := <-send:
+			if !ok {
+				return
+			}
+			a.logger.Info.Printf("--> %v", msg.Action)
+			if connClosed {
+				a.logger.Error.Printf("send message failed: connection is closed")
+			} else if !a.sendUntilAcked(ws, msg, ack, broken) {
 				connClosed = true
-			} else {
-				logger.Error.Printf("Close websocket connection failed: %v", err)
+			}
+			if connClosed && isReportMessage(msg) {
+				unacked = append(unacked, msg)
 			}
 		}
 	}
-	goto loop
 }
 
-func waitForMessageAck(ackId string, ack chan string) {
+func (a *Agent) sendUntilAcked(ws *websocket.Conn, msg *protocol.Message, ack chan string, broken chan bool) bool {
+	timeout := a.Config().SendMessageTimeout
+	for {
+		if err := protocol.SendMessage(ws, msg); err != nil {
+			a.logger.Error.Printf("send message failed: %v", err)
+			if err := ws.Close(); err != nil {
+				a.logger.Error.Printf("Close websocket connection failed: %v", err)
+			}
+			return false
+		}
+		acked, ok := a.waitForMessageAck(msg.AckId, ack, broken, timeout)
+		if acked {
+			return true
+		}
+		if !ok {
+			return false
+		}
+		if timeout *= 2; timeout > MaxSendMessageTimeout {
+			timeout = MaxSendMessageTimeout
+		}
+		messageResends.Inc(a.id)
+		a.logger.Warn.Printf("resend %v, id: %v", msg.Action, msg.AckId)
+	}
+}
+
+// waitForMessageAck returns ok false when connection is broken before
+// the message is acknowledged or timed out.
+func (a *Agent) waitForMessageAck(ackId string, ack chan string, broken chan bool, timeout time.Duration) (acked, ok bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
 		select {
-		case <-time.After(config.SendMessageTimeout):
-			LogInfo("wait for message ack timeout, id: %v", ackId)
-			return
+		case <-timer.C:
+			ackTimeouts.Inc(a.id)
+			a.logger.Warn.Printf("wait for message ack timeout, id: %v", ackId)
+			return false, true
+		case <-broken:
+			return false, false
 		case id := <-ack:
 			if id == ackId {
-				return
+				return true, true
 			} else {
-				LogInfo("ignore ack with id: %v, expected: %v", id, ackId)
+				a.logger.Info.Printf("ignore ack with id: %v, expected: %v", id, ackId)
 			}
 		}
 	}
 }
 
-func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ack chan string) {
-	defer LogDebug("! exit goroutine: receive message")
+// forwardMessages queues messages from in until they are taken from
+// out, so that receiving never waits for a busy agent and acks keep
+// coming in while agent is sending.
+func forwardMessages(in <-chan *protocol.Message, out chan<- *protocol.Message, closed <-chan bool) {
+	defer close(out)
+	var queue []*protocol.Message
+	for in != nil || len(queue) > 0 {
+		var next chan<- *protocol.Message
+		var head *protocol.Message
+		if len(queue) > 0 {
+			next, head = out, queue[0]
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				in = nil
+			} else {
+				queue = append(queue, msg)
+			}
+		case next <- head:
+			queue = queue[1:]
+		case <-closed:
+			return
+		}
+	}
+}
+
+// startReceiveMessage reads messages until the connection fails or is
+// closed. Nobody takes acks or messages once it is closed, so it stops
+// waiting to hand them over then.
+func (a *Agent) startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ack chan string, broken chan bool, closed chan bool) {
+	defer a.logger.Debug.Printf("! exit goroutine: receive message")
 	defer close(received)
+	defer close(broken)
 	for {
 		msg, err := protocol.ReceiveMessage(ws)
+		if _, ok := err.(*protocol.DecodeError); ok {
+			messageErrors.Inc(a.id)
+			a.logger.Warn.Printf("ignore message: %v", err)
+			continue
+		}
 		if err != nil {
-			logger.Error.Printf("receive message failed: %v", err)
+			a.logger.Error.Printf("receive message failed: %v", err)
 			return
 		}
-		LogInfo("<-- %v", msg.Action)
+		a.logger.Info.Printf("<-- %v", msg.Action)
 
-		if msg.Action == "ack" {
-			ack <- msg.DataString()
+		if msg.Action == protocol.AckAction {
+			id, err := msg.DataString()
+			if err != nil {
+				messageErrors.Inc(a.id)
+				a.logger.Warn.Printf("ignore message: %v", err)
+				continue
+			}
+			select {
+			case ack <- id:
+			case <-closed:
+				return
+			}
 		} else {
-			received <- msg
+			select {
+			case received <- msg:
+			case <-closed:
+				return
+			}
 		}
 	}
 }
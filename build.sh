@@ -24,6 +24,9 @@ go get golang.org/x/net/websocket
 go get github.com/satori/go.uuid
 go get github.com/xli/assert
 go get github.com/bmatcuk/doublestar
+go get github.com/antchfx/xpath
+go get github.com/antchfx/xmlquery
+go get gopkg.in/yaml.v2
 go get github.com/jstemmer/go-junit-report
 # go get -u all
 go test -test.v ./... | $GOPATH/bin/go-junit-report > testreport.xml
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/agent"
+	"os"
+	"time"
+)
+
+func registerAgent(args []string) int {
+	agents, err := newAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "register agent failed: %v\n", err)
+		return ExitError
+	}
+	code := ExitOK
+	for _, a := range agents {
+		err := a.Register()
+		if err == agent.ErrRegistrationPending {
+			fmt.Printf("agent %v is waiting for approval on Go server\n", a.Id())
+			code = ExitRegistrationPending
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "register agent failed: %v\n", err)
+			return ExitError
+		}
+		fmt.Printf("agent %v is registered\n", a.Id())
+	}
+	return code
+}
+
+func unregisterAgent(args []string) int {
+	agents, err := newAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unregister agent failed: %v\n", err)
+		return ExitError
+	}
+	for _, a := range agents {
+		if err := a.Unregister(); err != nil {
+			fmt.Fprintf(os.Stderr, "unregister agent failed: %v\n", err)
+			return ExitError
+		}
+		fmt.Printf("agent %v is unregistered\n", a.Id())
+	}
+	return ExitOK
+}
+
+func printStatus(args []string) int {
+	agents, err := newAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read agent status failed: %v\n", err)
+		return ExitError
+	}
+	for i, a := range agents {
+		if i > 0 {
+			fmt.Println()
+		}
+		config := a.Config()
+		fmt.Printf("agent id:          %v\n", a.Id())
+		fmt.Printf("certificate:       %v\n", certificateStatus(a))
+		fmt.Printf("server url:        %v\n", config.ServerUrl())
+		fmt.Printf("working directory: %v\n", config.WorkingDir)
+		fmt.Printf("config directory:  %v\n", config.ConfigDir)
+		fmt.Printf("config file:       %v\n", fileStatus(config.ConfigFile))
+		fmt.Printf("log directory:     %v\n", config.LogDir)
+		fmt.Printf("hostname:          %v\n", config.Hostname)
+		fmt.Printf("ip address:        %v\n", config.IpAddress)
+		fmt.Printf("resources:         %v\n", config.AgentAutoRegisterResources)
+		fmt.Printf("environments:      %v\n", config.AgentAutoRegisterEnvironments)
+		if config.AgentAutoRegisterElasticAgentId != "" {
+			fmt.Printf("elastic agent id:  %v\n", config.AgentAutoRegisterElasticAgentId)
+			fmt.Printf("elastic plugin id: %v\n", config.AgentAutoRegisterElasticPluginId)
+		}
+	}
+	return ExitOK
+}
+
+func certificateStatus(a *agent.Agent) string {
+	cert, err := a.ReadAgentCertificate()
+	if os.IsNotExist(err) {
+		return "not registered"
+	}
+	if err != nil {
+		return fmt.Sprintf("invalid: %v", err)
+	}
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return fmt.Sprintf("not valid until %v", cert.NotBefore)
+	case now.After(cert.NotAfter):
+		return fmt.Sprintf("expired at %v", cert.NotAfter)
+	default:
+		return fmt.Sprintf("valid until %v", cert.NotAfter)
+	}
+}
+
+func fileStatus(path string) string {
+	if _, err := os.Stat(path); err != nil {
+		return path + " (not found)"
+	}
+	return path
+}
+
+func configCommand(args []string) int {
+	if len(args) != 1 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: config validate")
+		return ExitUsage
+	}
+	errs := agent.ValidateConfig()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return ExitError
+	}
+	fmt.Println("config is valid")
+	return ExitOK
+}
+
+func printVersion(args []string) int {
+	fmt.Println(Version)
+	return ExitOK
+}
@@ -27,7 +27,7 @@ echo "Cross compiling for linux..."
 echo "############################"
 
 cd $PROJECT_DIR
-CGO_ENABLED=0 GOOS=linux go build -a -tags netgo -ldflags '-w' .
+CGO_ENABLED=0 GOOS=linux go build -a -tags netgo -ldflags "-w -X main.Version=$GGA_VERSION" .
 mkdir -p `dirname $BINARY_FILE`
 cp gocd-golang-agent $BINARY_FILE
 chmod 0755 $BINARY_FILE
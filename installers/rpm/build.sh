@@ -26,6 +26,9 @@ go get golang.org/x/net/websocket
 go get github.com/satori/go.uuid
 go get github.com/xli/assert
 go get github.com/bmatcuk/doublestar
+go get github.com/antchfx/xpath
+go get github.com/antchfx/xmlquery
+go get gopkg.in/yaml.v2
 go get github.com/jstemmer/go-junit-report
 mkdir -p $PROJECT_DIR/src/github.com/gocd-contrib/gocd-golang-agent/
 if [ ! -d $PROJECT_DIR/src/github.com/gocd-contrib/gocd-golang-agent/agent ]; then
@@ -60,7 +63,7 @@ echo "Cross compiling for linux..."
 echo "############################"
 
 cd $PROJECT_DIR
-CGO_ENABLED=0 GOOS=linux go build -a -tags netgo -ldflags '-w' .
+CGO_ENABLED=0 GOOS=linux go build -a -tags netgo -ldflags "-w -X main.Version=$GGA_VERSION" .
 chmod 0755 gocd-golang-agent
 cp gocd-golang-agent $RPM_BUILD_DIR/gocd-golang-agent-$GGA_VERSION/opt/gocd-golang-agent/bin
 
@@ -17,18 +17,145 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/gocd-contrib/gocd-golang-agent/agent"
-	"time"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
+const (
+	ExitOK                  = 0
+	ExitError               = 1
+	ExitUsage               = 2
+	ExitRegistrationPending = 3
+	ExitBuildFailed         = 4
+	ExitBuildCanceled       = 5
+)
+
+var Version = "dev"
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"run", "connect to Go server and run builds until stopped (default)", runAgent},
+		{"register", "register agent with Go server once, exit 3 if approval is pending", registerAgent},
+		{"unregister", "remove agent certificates and agent id", unregisterAgent},
+		{"status", "print agent id, certificate validity and config", printStatus},
+		{"config", "'config validate' checks environment variables and config file", configCommand},
+		{"version", "print agent version", printVersion},
+		{"help", "print this message", printUsage},
+	}
+}
+
 func main() {
-	agent.Initialize()
-	for {
-		err := agent.Start()
+	name := "run"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %v\n", name)
+	printUsage(nil)
+	os.Exit(ExitUsage)
+}
+
+func runAgent(args []string) int {
+	agents, err := newAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "start agent failed: %v\n", err)
+		return ExitError
+	}
+	if err := agent.StartAdminServer(agents...); err != nil {
+		fmt.Fprintf(os.Stderr, "start admin endpoint failed: %v\n", err)
+		return ExitError
+	}
+	go handleSignals(agents)
+	codes := make([]int, len(agents))
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		wg.Add(1)
+		go func(i int, a *agent.Agent) {
+			defer wg.Done()
+			codes[i] = run(a)
+		}(i, a)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		if code != ExitOK {
+			return code
+		}
+	}
+	return ExitOK
+}
+
+func newAgents() ([]*agent.Agent, error) {
+	config, err := agent.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var agents []*agent.Agent
+	for _, config := range config.AgentConfigs() {
+		a, err := agent.NewAgent(config)
 		if err != nil {
-			agent.LogInfo("something wrong: %v", err.Error())
+			return nil, err
 		}
-		agent.LogInfo("sleep 10 seconds and restart")
-		time.Sleep(10 * time.Second)
+		agents = append(agents, a)
+	}
+	return agents, nil
+}
+
+func run(a *agent.Agent) int {
+	if err := a.Run(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "agent %v stopped: %v\n", a.Id(), err)
+		return ExitError
+	}
+	if a.Config().OneShot {
+		switch a.LastBuildStatus() {
+		case protocol.BuildFailed:
+			return ExitBuildFailed
+		case protocol.BuildCanceled:
+			return ExitBuildCanceled
+		}
+	}
+	return ExitOK
+}
+
+func handleSignals(agents []*agent.Agent) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range signals {
+		for _, a := range agents {
+			a.Logger().Info.Printf("received signal: %v", sig)
+			if sig == syscall.SIGHUP {
+				if err := a.ReloadConfig(); err != nil {
+					a.Logger().Error.Printf("keep current config, reload failed: %v", err)
+				}
+			} else {
+				a.Shutdown()
+			}
+		}
+	}
+}
+
+func printUsage(args []string) int {
+	fmt.Fprintf(os.Stderr, "usage: %v [command]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12v %v\n", cmd.name, cmd.usage)
 	}
+	return ExitOK
 }
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var DefaultBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry keeps metrics in the order they are created and writes them
+// in Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: make(map[string]*counterValue)}
+	r.add(c)
+	return c
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, values: make(map[string]*histogramValue)}
+	r.add(h)
+	return h
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := r.metrics
+	r.mu.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic("metric " + d.name + " expects labels " + strings.Join(d.labels, ","))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, kind string) {
+	w.WriteString("# HELP " + d.name + " " + d.help + "\n")
+	w.WriteString("# TYPE " + d.name + " " + kind + "\n")
+}
+
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(d.name + suffix)
+	if len(values) > 0 || extraName != "" {
+		w.WriteString("{")
+		for i, label := range d.labels {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString(label + "=" + quote(values[i]))
+		}
+		if extraName != "" {
+			if len(values) > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString(extraName + "=" + quote(extraValue))
+		}
+		w.WriteString("}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func quote(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return `"` + v + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(v float64, labels ...string) {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: labels}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+func (c *Counter) Value(labels ...string) float64 {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cv, ok := c.values[key]; ok {
+		return cv.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		c.writeSample(w, "", nil, "", "", 0)
+		return
+	}
+	labels := make(map[string][]string)
+	for k, v := range c.values {
+		labels[k] = v.labels
+	}
+	for _, k := range sortedKeys(labels) {
+		c.writeSample(w, "", labels[k], "", "", c.values[k].value)
+	}
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) Count(labels ...string) uint64 {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	labels := make(map[string][]string)
+	for k, v := range h.values {
+		labels[k] = v.labels
+	}
+	for _, k := range sortedKeys(labels) {
+		hv := h.values[k]
+		for i, bound := range h.buckets {
+			h.writeSample(w, "_bucket", hv.labels, "le", formatFloat(bound), float64(hv.counts[i]))
+		}
+		h.writeSample(w, "_bucket", hv.labels, "le", "+Inf", float64(hv.count))
+		h.writeSample(w, "_sum", hv.labels, "", "", hv.sum)
+		h.writeSample(w, "_count", hv.labels, "", "", float64(hv.count))
+	}
+}
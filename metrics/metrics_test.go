@@ -0,0 +1,67 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/metrics"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestWriteCounters(t *testing.T) {
+	r := NewRegistry()
+	total := r.NewCounter("test_total", "Total tests.")
+	results := r.NewCounter("test_results_total", "Tests by result.", "result")
+	results.Inc("Passed")
+	results.Add(2, "Failed")
+	results.Inc("Passed")
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.Write(&buf))
+	expected := `# HELP test_total Total tests.
+# TYPE test_total counter
+test_total 0
+# HELP test_results_total Tests by result.
+# TYPE test_results_total counter
+test_results_total{result="Failed"} 2
+test_results_total{result="Passed"} 2
+`
+	assert.Equal(t, expected, buf.String())
+	assert.Equal(t, float64(0), total.Value())
+}
+
+func TestWriteHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_seconds", "Test duration.", []float64{1, 5}, "name")
+	h.Observe(0.5, `a "quoted"\name`)
+	h.Observe(3, `a "quoted"\name`)
+	h.Observe(10, `a "quoted"\name`)
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.Write(&buf))
+	expected := `# HELP test_seconds Test duration.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="a \"quoted\"\\name",le="1"} 1
+test_seconds_bucket{name="a \"quoted\"\\name",le="5"} 2
+test_seconds_bucket{name="a \"quoted\"\\name",le="+Inf"} 3
+test_seconds_sum{name="a \"quoted\"\\name"} 13.5
+test_seconds_count{name="a \"quoted\"\\name"} 3
+`
+	assert.Equal(t, expected, buf.String())
+	assert.Equal(t, uint64(3), h.Count(`a "quoted"\name`))
+}
@@ -16,6 +16,16 @@
 
 package protocol
 
+// BuildCommandProtocolVersion is increased whenever agent changes how it
+// interprets build commands.
+const BuildCommandProtocolVersion = 1
+
+// Optional features agent advertises in AgentRuntimeInfo.Features.
+const (
+	FeatureCrashRecovery  = "crashRecovery"
+	FeatureCommandTimeout = "commandTimeout"
+)
+
 type AgentIdentifier struct {
 	HostName  string `json:"hostName"`
 	IpAddress string `json:"ipAddress"`
@@ -39,4 +49,7 @@ type AgentRuntimeInfo struct {
 	ElasticPluginId              string             `json:"elasticPluginId"`
 	ElasticAgentId               string             `json:"elasticAgentId"`
 	SupportsBuildCommandProtocol bool               `json:"supportsBuildCommandProtocol"`
+	ProtocolVersion              int                `json:"protocolVersion,omitempty"`
+	SupportedCommands            []string           `json:"supportedCommands,omitempty"`
+	Features                     []string           `json:"features,omitempty"`
 }
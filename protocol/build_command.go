@@ -18,7 +18,10 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -46,6 +49,9 @@ const (
 	CommandDownloadDir         = "downloadDir"
 	CommandGenerateTestReport  = "generateTestReport"
 	CommandGenerateProperty    = "generateProperty"
+	CommandRetry               = "retry"
+	CommandParallel            = "parallel"
+	CommandForeach             = "foreach"
 )
 
 type BuildCommand struct {
@@ -56,6 +62,9 @@ type BuildCommand struct {
 	WorkingDirectory string
 	Test             *BuildCommand
 	OnCancel         *BuildCommand
+	// Timeout bounds how long the command, sub commands included, may
+	// run, e.g. "10m". No timeout when empty.
+	Timeout string `json:",omitempty"`
 }
 
 func NewBuildCommand(name string) *BuildCommand {
@@ -187,6 +196,35 @@ func GenerateTestReportCommand(args ...string) *BuildCommand {
 	return NewBuildCommand(CommandGenerateTestReport).AddArg("uploadPath", args[0]).AddListArg("srcs", args[1:])
 }
 
+// RetryCommand runs cmd up to attempts times until it passes, waiting
+// delay before the first retry and backoff times longer before each
+// following one.
+func RetryCommand(attempts int, delay time.Duration, backoff float64, cmd *BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandRetry).
+		AddArg("attempts", strconv.Itoa(attempts)).
+		AddArg("delay", delay.String()).
+		AddArg("backoff", strconv.FormatFloat(backoff, 'f', -1, 64)).
+		AddCommands(cmd)
+}
+
+func ParallelCommand(commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandParallel).AddCommands(commands...)
+}
+
+// ForeachCommand runs cmd once for each of items.
+func ForeachCommand(items []string, cmd *BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandForeach).AddListArg("items", items).AddCommands(cmd)
+}
+
+func GeneratePropertyCommand(name, src, xpath string) *BuildCommand {
+	args := map[string]string{
+		"name":  name,
+		"src":   src,
+		"xpath": xpath,
+	}
+	return NewBuildCommand(CommandGenerateProperty).SetArgs(args)
+}
+
 func (cmd *BuildCommand) RunIfAny() bool {
 	return strings.EqualFold(RunIfConfigAny, cmd.RunIfConfig)
 }
@@ -241,6 +279,26 @@ func (cmd *BuildCommand) SetOnCancel(c *BuildCommand) *BuildCommand {
 	return cmd
 }
 
+func (cmd *BuildCommand) SetTimeout(timeout time.Duration) *BuildCommand {
+	cmd.Timeout = timeout.String()
+	return cmd
+}
+
+// TimeoutDuration parses Timeout, it returns 0 when there is no timeout.
+func (cmd *BuildCommand) TimeoutDuration() (time.Duration, error) {
+	if cmd.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(cmd.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("%v is not positive", cmd.Timeout)
+	}
+	return timeout, nil
+}
+
 func (cmd *BuildCommand) ListArg(name string) (list []string, err error) {
 	err = json.Unmarshal([]byte(cmd.Args[name]), &list)
 	return
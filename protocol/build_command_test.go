@@ -20,6 +20,7 @@ import (
 	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/xli/assert"
 	"testing"
+	"time"
 )
 
 func TestListArg(t *testing.T) {
@@ -46,3 +47,18 @@ func TestAddCommands(t *testing.T) {
 	cmd.AddCommands(NewBuildCommand(CommandEcho))
 	assert.Equal(t, 1, len(cmd.SubCommands))
 }
+
+func TestTimeoutDuration(t *testing.T) {
+	timeout, err := NewBuildCommand(CommandEcho).TimeoutDuration()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	timeout, err = NewBuildCommand(CommandEcho).SetTimeout(90 * time.Second).TimeoutDuration()
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	_, err = (&BuildCommand{Timeout: "soon"}).TimeoutDuration()
+	assert.NotNil(t, err)
+	_, err = (&BuildCommand{Timeout: "0s"}).TimeoutDuration()
+	assert.NotNil(t, err)
+}
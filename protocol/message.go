@@ -18,6 +18,7 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/satori/go.uuid"
 )
 
@@ -31,6 +32,7 @@ const (
 	ReportCurrentStatusAction = "reportCurrentStatus"
 	ReportCompletingAction    = "reportCompleting"
 	ReportCompletedAction     = "reportCompleted"
+	MessageErrorAction        = "messageError"
 )
 
 type Message struct {
@@ -39,28 +41,74 @@ type Message struct {
 	AckId  string `json:"ackId"`
 }
 
-func (m *Message) DataBuild() *Build {
+// DecodeError is returned when a message, or the data of a message,
+// can't be decoded. Action is empty when the message itself is broken.
+type DecodeError struct {
+	Action string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Action == "" {
+		return fmt.Sprintf("invalid message: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid %v message: %v", e.Action, e.Err)
+}
+
+// MessageError is sent back to the server for a message agent could
+// not process, e.g. a message with an unknown action.
+type MessageError struct {
+	Action string `json:"action"`
+	AckId  string `json:"ackId"`
+	Error  string `json:"error"`
+}
+
+func (m *Message) decodeData(v interface{}) error {
+	if err := json.Unmarshal([]byte(m.Data), v); err != nil {
+		return &DecodeError{Action: m.Action, Err: err}
+	}
+	return nil
+}
+
+func (m *Message) DataBuild() (*Build, error) {
 	var build Build
-	json.Unmarshal([]byte(m.Data), &build)
-	return &build
+	if err := m.decodeData(&build); err != nil {
+		return nil, err
+	}
+	if build.BuildCommand == nil {
+		return nil, &DecodeError{Action: m.Action, Err: fmt.Errorf("build %v has no build command", build.BuildId)}
+	}
+	return &build, nil
 }
 
-func (m *Message) DataString() string {
+func (m *Message) DataString() (string, error) {
 	var str string
-	json.Unmarshal([]byte(m.Data), &str)
-	return str
+	err := m.decodeData(&str)
+	return str, err
 }
 
-func (m *Message) AgentRuntimeInfo() *AgentRuntimeInfo {
+func (m *Message) AgentRuntimeInfo() (*AgentRuntimeInfo, error) {
 	var info AgentRuntimeInfo
-	json.Unmarshal([]byte(m.Data), &info)
-	return &info
+	if err := m.decodeData(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
 }
 
-func (m *Message) Report() *Report {
+func (m *Message) Report() (*Report, error) {
 	var report Report
-	json.Unmarshal([]byte(m.Data), &report)
-	return &report
+	if err := m.decodeData(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (m *Message) DataMessageError() (*MessageError, error) {
+	var e MessageError
+	if err := m.decodeData(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
 }
 
 func newMessage(action string, data interface{}) *Message {
@@ -100,6 +148,10 @@ func CompletedMessage(report *Report) *Message {
 	return ReportMessage(ReportCompletedAction, report)
 }
 
+func MessageErrorMessage(msg *Message, err error) *Message {
+	return newMessage(MessageErrorAction, &MessageError{Action: msg.Action, AckId: msg.AckId, Error: err.Error()})
+}
+
 func ReregisterMessage() *Message {
 	return &Message{Action: ReregisterAction}
 }
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"golang.org/x/net/websocket"
+	"reflect"
+	"testing"
+)
+
+func TestMessageDataDecodeErrors(t *testing.T) {
+	msg := &Message{Action: BuildAction, Data: "{"}
+	_, err := msg.DataBuild()
+	decodeErr, ok := err.(*DecodeError)
+	assert.True(t, ok)
+	assert.Equal(t, BuildAction, decodeErr.Action)
+
+	_, err = (&Message{Action: BuildAction, Data: `{"BuildId":"1"}`}).DataBuild()
+	assert.NotNil(t, err)
+
+	_, err = (&Message{Action: SetCookieAction, Data: "1"}).DataString()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: ReportCompletedAction, Data: "[]"}).Report()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: PingAction, Data: ""}).AgentRuntimeInfo()
+	assert.NotNil(t, err)
+}
+
+func TestUnmarshalReturnsDecodeErrorForBrokenFrames(t *testing.T) {
+	var msg Message
+	_, ok := MessageUnmarshal([]byte("not gzip"), websocket.BinaryFrame, &msg).(*DecodeError)
+	assert.True(t, ok)
+
+	data, _, err := MessageMarshal(CompletedMessage(&Report{BuildId: "1"}))
+	assert.Nil(t, err)
+	_, ok = MessageUnmarshal(data[:len(data)-4], websocket.BinaryFrame, &msg).(*DecodeError)
+	assert.True(t, ok)
+}
+
+func FuzzMessageCodec(f *testing.F) {
+	for _, msg := range []*Message{
+		SetCookieMessage("cookie"),
+		BuildMessage(&Build{BuildId: "1", BuildCommand: NewBuildCommand(CommandEcho)}),
+		PingMessage(&AgentRuntimeInfo{RuntimeStatus: "Idle"}),
+		CompletedMessage(&Report{BuildId: "1", Result: BuildPassed}),
+		ReregisterMessage(),
+	} {
+		data, _, err := MessageMarshal(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add(gzipped(`{"action": 1}`))
+	f.Add(gzipped(`{"action": "build", "data": "{\"BuildCommand\": {\"SubCommands\": [null]}}"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		err := MessageUnmarshal(data, websocket.BinaryFrame, &msg)
+		if err != nil {
+			if _, ok := err.(*DecodeError); !ok {
+				t.Fatalf("expected DecodeError, got %T: %v", err, err)
+			}
+			return
+		}
+		_, err = msg.DataBuild()
+		checkDecodeError(t, err)
+		_, err = msg.DataString()
+		checkDecodeError(t, err)
+		_, err = msg.Report()
+		checkDecodeError(t, err)
+		_, err = msg.AgentRuntimeInfo()
+		checkDecodeError(t, err)
+
+		again, _, err := MessageMarshal(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Message
+		if err := MessageUnmarshal(again, websocket.BinaryFrame, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, decoded) {
+			t.Fatalf("%+v changed to %+v after encoding", msg, decoded)
+		}
+	})
+}
+
+func checkDecodeError(t *testing.T, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("expected DecodeError, got %T: %v", err, err)
+	}
+}
+
+func gzipped(s string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.Bytes()
+}
@@ -18,13 +18,108 @@ package protocol
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"encoding/json"
 	"golang.org/x/net/websocket"
+	"io"
 	"io/ioutil"
+	"strings"
 )
 
-func messageMarshal(v interface{}) ([]byte, byte, error) {
+// Websocket codecs agent and Go server can agree on during the
+// handshake. Each codec is offered as websocket sub protocol
+// "gocd.<codec>"; connections without one use gzip.
+const (
+	// GzipCodec sends gzipped JSON in binary frames.
+	GzipCodec = "gzip"
+	// JSONCodec sends plain JSON in text frames.
+	JSONCodec = "json"
+	// RawDeflateCodec sends raw DEFLATE compressed JSON in binary
+	// frames. It is a codec of its own, negotiated as sub protocol
+	// "gocd.raw-deflate"; it is not the permessage-deflate extension of
+	// RFC 7692 and does not interoperate with servers or proxies that
+	// speak that extension.
+	RawDeflateCodec = "raw-deflate"
+
+	subProtocolPrefix = "gocd."
+)
+
+var WebsocketCodecs = []string{GzipCodec, JSONCodec, RawDeflateCodec}
+
+// deflateTail ends every deflated message, it is removed after
+// deflating to save a few bytes. When inflating, an empty final
+// block follows it so that the reader sees the end of the stream.
+var (
+	deflateTail  = []byte{0x00, 0x00, 0xff, 0xff}
+	deflateFinal = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+var codecs = map[string]websocket.Codec{
+	GzipCodec:       {Marshal: gzipMarshal, Unmarshal: gzipUnmarshal},
+	JSONCodec:       {Marshal: jsonMarshal, Unmarshal: jsonUnmarshal},
+	RawDeflateCodec: {Marshal: deflateMarshal, Unmarshal: deflateUnmarshal},
+}
+
+func IsWebsocketCodec(codec string) bool {
+	_, ok := codecs[codec]
+	return ok
+}
+
+// OfferCodec returns the sub protocols agent offers for codec. Gzip
+// is always offered last, so that a Go server which knows nothing
+// about codecs and ignores the offer still gets what it expects.
+func OfferCodec(codec string) []string {
+	protocols := []string{subProtocolPrefix + codec}
+	if codec != GzipCodec {
+		protocols = append(protocols, subProtocolPrefix+GzipCodec)
+	}
+	return protocols
+}
+
+// SelectCodec picks the first offered sub protocol of a codec in
+// supported, it returns no protocol when nothing matches, which
+// means gzip.
+func SelectCodec(offered []string, supported []string) []string {
+	for _, p := range offered {
+		codec := strings.TrimPrefix(p, subProtocolPrefix)
+		if codec == p {
+			continue
+		}
+		for _, s := range supported {
+			if s == codec {
+				return []string{p}
+			}
+		}
+	}
+	return nil
+}
+
+// Codec returns the codec negotiated for conn.
+func Codec(conn *websocket.Conn) string {
+	protocols := conn.Config().Protocol
+	if len(protocols) == 1 {
+		codec := strings.TrimPrefix(protocols[0], subProtocolPrefix)
+		if IsWebsocketCodec(codec) {
+			return codec
+		}
+	}
+	return GzipCodec
+}
+
+func jsonMarshal(v interface{}) ([]byte, byte, error) {
+	data, err := json.Marshal(v)
+	return data, websocket.TextFrame, err
+}
+
+func jsonUnmarshal(msg []byte, payloadType byte, v interface{}) error {
+	if err := json.Unmarshal(msg, v); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+func gzipMarshal(v interface{}) ([]byte, byte, error) {
 	json, jerr := json.Marshal(v)
 	if jerr != nil {
 		return []byte{}, websocket.BinaryFrame, jerr
@@ -37,20 +132,53 @@ func messageMarshal(v interface{}) ([]byte, byte, error) {
 	return b.Bytes(), websocket.BinaryFrame, err
 }
 
-func messageUnmarshal(msg []byte, payloadType byte, v interface{}) (err error) {
-	reader, _ := gzip.NewReader(bytes.NewBuffer(msg))
-	jsonBytes, _ := ioutil.ReadAll(reader)
-	return json.Unmarshal(jsonBytes, v)
+func gzipUnmarshal(msg []byte, payloadType byte, v interface{}) error {
+	reader, err := gzip.NewReader(bytes.NewBuffer(msg))
+	if err != nil {
+		return &DecodeError{Err: err}
+	}
+	return readJSON(reader, v)
+}
+
+func deflateMarshal(v interface{}) ([]byte, byte, error) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		return []byte{}, websocket.BinaryFrame, err
+	}
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.DefaultCompression)
+	if _, err := w.Write(json); err != nil {
+		return []byte{}, websocket.BinaryFrame, err
+	}
+	if err := w.Flush(); err != nil {
+		return []byte{}, websocket.BinaryFrame, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), deflateTail), websocket.BinaryFrame, nil
 }
 
-var messageCodec = websocket.Codec{messageMarshal, messageUnmarshal}
+func deflateUnmarshal(msg []byte, payloadType byte, v interface{}) error {
+	reader := flate.NewReader(io.MultiReader(bytes.NewReader(msg), bytes.NewReader(deflateTail), bytes.NewReader(deflateFinal)))
+	defer reader.Close()
+	return readJSON(reader, v)
+}
+
+func readJSON(reader io.Reader, v interface{}) error {
+	jsonBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return &DecodeError{Err: err}
+	}
+	if err := json.Unmarshal(jsonBytes, v); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
 
 func ReceiveMessage(conn *websocket.Conn) (*Message, error) {
 	var msg Message
-	err := messageCodec.Receive(conn, &msg)
+	err := codecs[Codec(conn)].Receive(conn, &msg)
 	return &msg, err
 }
 
 func SendMessage(conn *websocket.Conn, msg *Message) error {
-	return messageCodec.Send(conn, msg)
+	return codecs[Codec(conn)].Send(conn, msg)
 }
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"golang.org/x/net/websocket"
+	"testing"
+)
+
+func TestCodecsEncodeAndDecodeMessages(t *testing.T) {
+	frames := map[string]byte{
+		GzipCodec:       websocket.BinaryFrame,
+		JSONCodec:       websocket.TextFrame,
+		RawDeflateCodec: websocket.BinaryFrame,
+	}
+	for _, name := range WebsocketCodecs {
+		codec := Codecs[name]
+		msg := CompletedMessage(&Report{BuildId: "1", Result: BuildPassed})
+		data, payloadType, err := codec.Marshal(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, frames[name], payloadType)
+
+		var decoded Message
+		assert.Nil(t, codec.Unmarshal(data, payloadType, &decoded))
+		assert.Equal(t, msg.Action, decoded.Action)
+		assert.Equal(t, msg.Data, decoded.Data)
+
+		_, ok := codec.Unmarshal([]byte("\xff{"), payloadType, &decoded).(*DecodeError)
+		assert.True(t, ok)
+	}
+}
+
+func TestRawDeflateCodecStripsFlushTail(t *testing.T) {
+	data, _, err := Codecs[RawDeflateCodec].Marshal(PingMessage(&AgentRuntimeInfo{RuntimeStatus: "Idle"}))
+	assert.Nil(t, err)
+	assert.False(t, bytes.HasSuffix(data, []byte{0x00, 0x00, 0xff, 0xff}))
+}
+
+func TestOfferCodecFallsBackToGzip(t *testing.T) {
+	assert.Equal(t, []string{"gocd.gzip"}, OfferCodec(GzipCodec))
+	assert.Equal(t, []string{"gocd.json", "gocd.gzip"}, OfferCodec(JSONCodec))
+}
+
+func TestSelectCodec(t *testing.T) {
+	offered := OfferCodec(RawDeflateCodec)
+	assert.Equal(t, []string{"gocd.raw-deflate"}, SelectCodec(offered, WebsocketCodecs))
+	assert.Equal(t, []string{"gocd.gzip"}, SelectCodec(offered, []string{GzipCodec}))
+	assert.Nil(t, SelectCodec(offered, []string{JSONCodec}))
+	assert.Nil(t, SelectCodec([]string{"chat", "deflate"}, WebsocketCodecs))
+	assert.False(t, IsWebsocketCodec("permessage-deflate"))
+	assert.Nil(t, SelectCodec(nil, WebsocketCodecs))
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// propertiesHandler sets build property /properties/builds/<build id>/<name>
+// to form value "value". A property can only be set once.
+func propertiesHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, PropertiesPath+"/builds/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			s.responseBadRequest(fmt.Errorf("invalid property path %v", req.URL.Path), w)
+			return
+		}
+		buildId, name := parts[0], parts[1]
+		value := req.FormValue("value")
+		filename := s.PropertyFile(buildId, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Property '%v' is already set.", name)
+			return
+		} else if err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		defer f.Close()
+		if _, err := f.WriteString(value); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		s.log("set property %v of build %v to %v", name, buildId, value)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Property '%v' created with value '%v'", name, value)
+	}
+}
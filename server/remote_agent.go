@@ -22,11 +22,20 @@ import (
 	"github.com/satori/go.uuid"
 	"golang.org/x/net/websocket"
 	"io"
+	"sync"
+	"time"
 )
 
 type RemoteAgent struct {
-	conn *websocket.Conn
-	id   string
+	conn          *websocket.Conn
+	id            string
+	closed        chan bool
+	silenceMu     sync.Mutex
+	silenceLength time.Duration
+}
+
+func NewRemoteAgent(conn *websocket.Conn) *RemoteAgent {
+	return &RemoteAgent{conn: conn, closed: make(chan bool)}
 }
 
 func (agent *RemoteAgent) Listen(server *Server) error {
@@ -34,37 +43,87 @@ func (agent *RemoteAgent) Listen(server *Server) error {
 		msg, err := protocol.ReceiveMessage(agent.conn)
 		if err == io.EOF {
 			return err
+		} else if agent.isClosed() {
+			return io.EOF
 		} else if err != nil {
 			server.error("receive error: %v", err)
+		} else if d := agent.takeSilence(); d > 0 {
+			server.log("silent for %v, drop message: %v", d, msg.Action)
+			time.Sleep(d)
 		} else {
 			agent.processMessage(server, msg)
 		}
 	}
 }
 
+func (agent *RemoteAgent) silence(d time.Duration) {
+	agent.silenceMu.Lock()
+	defer agent.silenceMu.Unlock()
+	agent.silenceLength = d
+}
+
+func (agent *RemoteAgent) takeSilence() time.Duration {
+	agent.silenceMu.Lock()
+	defer agent.silenceMu.Unlock()
+	d := agent.silenceLength
+	agent.silenceLength = 0
+	return d
+}
+
 func (agent *RemoteAgent) processMessage(server *Server, msg *protocol.Message) {
 	server.log("received message: %v", msg.Action)
-	err := agent.Ack(msg)
-	if err != nil {
+	if server.shouldDropMessage(msg) {
+		server.log("drop message: %v", msg.AckId)
+		return
+	}
+	if server.shouldDropAck(msg) {
+		server.log("drop ack of message: %v", msg.AckId)
+	} else if err := agent.Ack(msg); err != nil {
 		server.error("ack error: %v", err)
 	}
+	if !server.firstDelivery(msg) {
+		server.log("ignore duplicated message: %v", msg.AckId)
+		return
+	}
+	if err := agent.process(server, msg); err != nil {
+		server.error("process message error: %v", err)
+	}
+}
+
+func (agent *RemoteAgent) process(server *Server, msg *protocol.Message) error {
 	switch msg.Action {
 	case protocol.PingAction:
-		info := msg.AgentRuntimeInfo()
+		info, err := msg.AgentRuntimeInfo()
+		if err != nil {
+			return err
+		}
 		if agent.id == "" {
 			agent.id = info.Identifier.Uuid
-			server.add(agent)
+			server.agentConnected(agent)
 			agent.SetCookie()
 		}
 		agentState := info.RuntimeStatus
 		server.notifyAgent(agent.id, agentState)
 	case "reportCurrentStatus":
-		report := msg.Report()
+		report, err := msg.Report()
+		if err != nil {
+			return err
+		}
 		server.notifyBuild(report.BuildId, report.JobState)
 	case "reportCompleting", "reportCompleted":
-		report := msg.Report()
+		report, err := msg.Report()
+		if err != nil {
+			return err
+		}
 		server.notifyBuild(report.BuildId, report.Result)
+	case protocol.MessageErrorAction:
+		e, err := msg.DataMessageError()
+		if err != nil {
+			return err
+		}
+		server.notify("messageError", agent.id, e.Action)
 	}
+	return nil
 }
 
 func (agent *RemoteAgent) Send(msg *protocol.Message) error {
@@ -88,5 +147,20 @@ func (agent *RemoteAgent) String() string {
 }
 
 func (agent *RemoteAgent) Close() error {
+	select {
+	case <-agent.closed:
+		return nil
+	default:
+		close(agent.closed)
+	}
 	return agent.conn.Close()
 }
+
+func (agent *RemoteAgent) isClosed() bool {
+	select {
+	case <-agent.closed:
+		return true
+	default:
+		return false
+	}
+}
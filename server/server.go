@@ -28,6 +28,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -44,6 +45,11 @@ type StateListener interface {
 	Notify(class, id, state string)
 }
 
+type agentSilence struct {
+	agentId  string
+	duration time.Duration
+}
+
 type AgentMessage struct {
 	agentId string
 	Msg     *protocol.Message
@@ -57,23 +63,37 @@ type Server struct {
 	Logger               *log.Logger
 	StateListeners       []StateListener
 	maxRequestEntitySize int64
+	dropAcks             map[string]int
+	dropMessages         map[string]int
+	processed            map[string]bool
+	websocketCodecs      []string
+	agentCodecs          map[string]string
 	fieldChangeMu        sync.Mutex
 
-	addAgent    chan *RemoteAgent
-	delAgent    chan *RemoteAgent
-	sendMessage chan *AgentMessage
+	addAgent        chan *RemoteAgent
+	delAgent        chan *RemoteAgent
+	sendMessage     chan *AgentMessage
+	disconnectAgent chan string
+	silenceAgent    chan *agentSilence
 }
 
 func New(address, certFile, keyFile, workingDir string, logger *log.Logger) *Server {
 	return &Server{
-		Address:     address,
-		CertPemFile: certFile,
-		KeyPemFile:  keyFile,
-		WorkingDir:  workingDir,
-		Logger:      logger,
-		addAgent:    make(chan *RemoteAgent),
-		delAgent:    make(chan *RemoteAgent),
-		sendMessage: make(chan *AgentMessage),
+		Address:         address,
+		CertPemFile:     certFile,
+		KeyPemFile:      keyFile,
+		WorkingDir:      workingDir,
+		Logger:          logger,
+		dropAcks:        make(map[string]int),
+		dropMessages:    make(map[string]int),
+		processed:       make(map[string]bool),
+		websocketCodecs: protocol.WebsocketCodecs,
+		agentCodecs:     make(map[string]string),
+		addAgent:        make(chan *RemoteAgent),
+		delAgent:        make(chan *RemoteAgent),
+		sendMessage:     make(chan *AgentMessage),
+		disconnectAgent: make(chan string),
+		silenceAgent:    make(chan *agentSilence),
 	}
 
 }
@@ -84,6 +104,7 @@ func (s *Server) Start() error {
 	s.HandleFunc(RegistrationPath, registorHandler(s))
 	s.HandleFunc(ConsoleLogPath+"/", consoleHandler(s))
 	s.HandleFunc(ArtifactsPath+"/", artifactsHandler(s))
+	s.HandleFunc(PropertiesPath+"/", propertiesHandler(s))
 	s.HandleFunc(StatusPath, statusHandler())
 	s.log("listen to %v", s.Address)
 	return http.ListenAndServeTLS(s.Address, s.CertPemFile, s.KeyPemFile, nil)
@@ -117,6 +138,85 @@ func (s *Server) MaxRequestEntitySize() int64 {
 	return s.maxRequestEntitySize
 }
 
+// SetWebsocketCodecs limits the codecs server accepts in websocket
+// handshake, all codecs are accepted by default.
+func (s *Server) SetWebsocketCodecs(codecs ...string) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.websocketCodecs = codecs
+}
+
+// WebsocketCodec returns the codec of the last websocket connection
+// of the agent.
+func (s *Server) WebsocketCodec(agentId string) string {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.agentCodecs[agentId]
+}
+
+func (s *Server) selectCodec(config *websocket.Config, req *http.Request) error {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	config.Protocol = protocol.SelectCodec(config.Protocol, s.websocketCodecs)
+	return nil
+}
+
+func (s *Server) agentConnected(agent *RemoteAgent) {
+	s.fieldChangeMu.Lock()
+	s.agentCodecs[agent.id] = protocol.Codec(agent.conn)
+	s.fieldChangeMu.Unlock()
+	s.add(agent)
+}
+
+// DropAcks makes server not acknowledge the next count messages of
+// the given action, so that agent has to send them again.
+func (s *Server) DropAcks(action string, count int) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.dropAcks[action] = count
+}
+
+// DropMessages makes server lose the next count messages of the given
+// action, they are neither processed nor acknowledged.
+func (s *Server) DropMessages(action string, count int) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.dropMessages[action] = count
+}
+
+func (s *Server) shouldDropAck(msg *protocol.Message) bool {
+	return s.countDown(s.dropAcks, msg.Action)
+}
+
+func (s *Server) shouldDropMessage(msg *protocol.Message) bool {
+	return s.countDown(s.dropMessages, msg.Action)
+}
+
+func (s *Server) countDown(counts map[string]int, action string) bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	if counts[action] > 0 {
+		counts[action]--
+		return true
+	}
+	return false
+}
+
+// firstDelivery tells whether the message is seen for the first time,
+// resent messages have the same AckId.
+func (s *Server) firstDelivery(msg *protocol.Message) bool {
+	if msg.AckId == "" {
+		return true
+	}
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	if s.processed[msg.AckId] {
+		return false
+	}
+	s.processed[msg.AckId] = true
+	return true
+}
+
 func (s *Server) ConsoleLog(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ConsoleLogFile(buildId))
 	return string(bytes), err
@@ -143,6 +243,15 @@ func (s *Server) ChecksumFile(buildId string) string {
 	return filepath.Join(s.WorkingDir, buildId, "md5.checksum")
 }
 
+func (s *Server) Property(buildId, name string) (string, error) {
+	bytes, err := ioutil.ReadFile(s.PropertyFile(buildId, name))
+	return string(bytes), err
+}
+
+func (s *Server) PropertyFile(buildId, name string) string {
+	return filepath.Join(s.WorkingDir, buildId, "properties", name)
+}
+
 func (s *Server) ConsoleLogFile(buildId string) string {
 	return filepath.Join(s.WorkingDir, buildId, "console.log")
 }
@@ -151,6 +260,18 @@ func (s *Server) Send(agentId string, msg *protocol.Message) {
 	s.sendMessage <- &AgentMessage{agentId: agentId, Msg: msg}
 }
 
+func (s *Server) Disconnect(agentId string) {
+	s.disconnectAgent <- agentId
+}
+
+// Silence makes server stop reading from the current connection of
+// the agent for the given duration once it receives the next message,
+// so that the agent sees neither acks nor pongs, like a half-open
+// connection. The message is dropped.
+func (s *Server) Silence(agentId string, d time.Duration) {
+	s.silenceAgent <- &agentSilence{agentId: agentId, duration: d}
+}
+
 func (s *Server) log(format string, v ...interface{}) {
 	s.Logger.Printf(format, v...)
 }
@@ -208,7 +329,20 @@ func manageAgents(s *Server) {
 		case agent := <-s.addAgent:
 			agents[agent.id] = agent
 		case agent := <-s.delAgent:
-			delete(agents, agent.id)
+			if agents[agent.id] == agent {
+				delete(agents, agent.id)
+			}
+		case agentId := <-s.disconnectAgent:
+			agent := agents[agentId]
+			if agent != nil {
+				s.log("disconnect %v", agent)
+				agent.Close()
+				delete(agents, agentId)
+			}
+		case as := <-s.silenceAgent:
+			if agent := agents[as.agentId]; agent != nil {
+				agent.silence(as.duration)
+			}
 		case am := <-s.sendMessage:
 			agent := agents[am.agentId]
 			if agent != nil {
@@ -258,9 +392,9 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func websocketHandler(s *Server) websocket.Handler {
-	return websocket.Handler(func(ws *websocket.Conn) {
-		agent := &RemoteAgent{conn: ws}
+func websocketHandler(s *Server) websocket.Server {
+	return websocket.Server{Handshake: s.selectCodec, Handler: func(ws *websocket.Conn) {
+		agent := NewRemoteAgent(ws)
 		s.log("websocket connection is open for %v", agent)
 		err := agent.Listen(s)
 		s.del(agent)
@@ -271,7 +405,7 @@ func websocketHandler(s *Server) websocket.Handler {
 				s.error("error when closing websocket connection for %v: %v", agent, err)
 			}
 		}
-	})
+	}}
 }
 
 func parseBuildId(path string) string {
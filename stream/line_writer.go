@@ -0,0 +1,70 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// LineWriter buffers output until a line is complete, so that lines
+// of several LineWriters sharing one writer never interleave. Writes
+// to the shared writer are guarded by mu.
+type LineWriter struct {
+	io.Writer
+	mu  *sync.Mutex
+	buf bytes.Buffer
+}
+
+func NewLineWriter(writer io.Writer, mu *sync.Mutex) *LineWriter {
+	return &LineWriter{Writer: writer, mu: mu}
+}
+
+// Write keeps out in the buffer until its lines are complete. When
+// writing complete lines fails they are dropped, and the bytes of out
+// in them are not counted as written.
+func (w *LineWriter) Write(out []byte) (int, error) {
+	pending := w.buf.Len()
+	w.buf.Write(out)
+	i := bytes.LastIndexByte(w.buf.Bytes(), '\n')
+	if i < 0 {
+		return len(out), nil
+	}
+	if err := w.write(w.buf.Next(i + 1)); err != nil {
+		return len(out) - (i + 1 - pending), err
+	}
+	return len(out), nil
+}
+
+// Flush writes the last incomplete line, ending it with a newline.
+func (w *LineWriter) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	w.buf.WriteByte('\n')
+	return w.write(w.buf.Next(w.buf.Len()))
+}
+
+func (w *LineWriter) write(lines []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the writer may keep lines after Write returns, while buf is
+	// reused for the next write
+	_, err := w.Writer.Write(append([]byte(nil), lines...))
+	return err
+}
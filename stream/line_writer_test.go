@@ -0,0 +1,88 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"sync"
+	"testing"
+)
+
+type recordWriter struct {
+	writes []string
+}
+
+func (w *recordWriter) Write(out []byte) (int, error) {
+	w.writes = append(w.writes, string(out))
+	return len(out), nil
+}
+
+func TestLineWriterWritesCompleteLines(t *testing.T) {
+	var out recordWriter
+	w := NewLineWriter(&out, &sync.Mutex{})
+	for _, d := range []string{"hel", "lo\nwor", "ld\n", "!\n!", "!"} {
+		size, err := w.Write([]byte(d))
+		assert.Nil(t, err)
+		assert.Equal(t, len(d), size)
+	}
+	assert.Nil(t, w.Flush())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, []string{"hello\n", "world\n", "!\n", "!!\n"}, out.writes)
+}
+
+type brokenWriter struct{}
+
+func (w brokenWriter) Write(out []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+func TestLineWriterDoesNotCountBytesOfLinesItFailedToWrite(t *testing.T) {
+	w := NewLineWriter(brokenWriter{}, &sync.Mutex{})
+	size, err := w.Write([]byte("hel"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, size)
+	size, err = w.Write([]byte("lo\nwor"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, size)
+}
+
+func TestLineWritersSharingWriterDoNotInterleaveLines(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, prefix := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			w := NewPrefixWriter(NewLineWriter(&out, &mu), func() []byte { return []byte(prefix + " ") })
+			for i := 0; i < 100; i++ {
+				w.Write([]byte(prefix))
+				w.Write([]byte(prefix + "\n"))
+			}
+		}(prefix)
+	}
+	wg.Wait()
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	assert.Equal(t, 300, len(lines))
+	for _, line := range lines {
+		p := string(line[:1])
+		assert.Equal(t, p+" "+p+p, string(line))
+	}
+}
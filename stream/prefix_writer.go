@@ -38,6 +38,7 @@ func (w *PrefixWriter) Write(out []byte) (int, error) {
 	ln := []byte{'\n'}
 	lines := bytes.Split(out, ln)
 	last := len(lines) - 1
+	written := 0
 	for i, line := range lines {
 		if i == last && len(line) == 0 {
 			w.ap = true
@@ -45,13 +46,20 @@ func (w *PrefixWriter) Write(out []byte) (int, error) {
 		}
 		if i > 0 || w.ap {
 			if err := w.appendPrefix(); err != nil {
-				return -1, err
+				return written, err
 			}
 			w.ap = false
 		}
-		w.Writer.Write(line)
+		n, err := w.Writer.Write(line)
+		written += n
+		if err != nil {
+			return written, err
+		}
 		if i < last {
-			w.Writer.Write(ln)
+			if _, err := w.Writer.Write(ln); err != nil {
+				return written, err
+			}
+			written++
 		}
 	}
 	return len(out), nil
@@ -55,3 +55,10 @@ func TestPrefixWriter(t *testing.T) {
 		assert.Equal(t, test.output, buf.String())
 	}
 }
+
+func TestPrefixWriterCountsBytesWrittenBeforeError(t *testing.T) {
+	w := NewPrefixWriter(brokenWriter{}, func() []byte { return []byte("> ") })
+	size, err := w.Write([]byte("hello\nworld"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, size)
+}